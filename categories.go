@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ScoreMaster supports up to nine category axes, Cat1 - Cat9
+const numCatAxes = 9
+
+const CategorySQL = `SELECT Axis,Cat,IfNull(BriefDesc,'') FROM categories`
+
+const AxisSQL = `SELECT 1,IfNull(Cat1Label,'') FROM rallyparams
+UNION SELECT 2,IfNull(Cat2Label,'') FROM rallyparams
+UNION SELECT 3,IfNull(Cat3Label,'') FROM rallyparams
+UNION SELECT 4,IfNull(Cat4Label,'') FROM rallyparams
+UNION SELECT 5,IfNull(Cat5Label,'') FROM rallyparams
+UNION SELECT 6,IfNull(Cat6Label,'') FROM rallyparams
+UNION SELECT 7,IfNull(Cat7Label,'') FROM rallyparams
+UNION SELECT 8,IfNull(Cat8Label,'') FROM rallyparams
+UNION SELECT 9,IfNull(Cat9Label,'') FROM rallyparams
+`
+
+// Category is one resolved CatN value of a bonus or combo
+type Category struct {
+	Axis      int
+	AxisName  string
+	Cat       int
+	BriefDesc string
+}
+
+// AxisNames holds the names of each category axis, indexed 1 - 9
+var AxisNames [numCatAxes + 1]string
+
+// CategoryNames maps axis, category code to the category's description
+var CategoryNames = make(map[int]map[int]string)
+
+// loadCategories reads the category axis names and descriptions from the
+// database. Failure is reported but isn't fatal, bare numbers are used instead.
+func loadCategories() {
+
+	sqlx := CFG.AxisSQL
+	if sqlx == "" {
+		sqlx = AxisSQL
+	}
+	rows, err := DBH.Query(sqlx)
+	if err != nil {
+		fmt.Printf("Can't load category axes: %v\n", err)
+	} else {
+		for rows.Next() {
+			var axis int
+			var name string
+			err = rows.Scan(&axis, &name)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				continue
+			}
+			if axis > 0 && axis <= numCatAxes {
+				AxisNames[axis] = name
+			}
+		}
+		rows.Close()
+	}
+
+	sqlx = CFG.CategorySQL
+	if sqlx == "" {
+		sqlx = CategorySQL
+	}
+	rows, err = DBH.Query(sqlx)
+	if err != nil {
+		fmt.Printf("Can't load categories: %v\n", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var axis, cat int
+		var desc string
+		err = rows.Scan(&axis, &cat, &desc)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			continue
+		}
+		if CategoryNames[axis] == nil {
+			CategoryNames[axis] = make(map[int]string)
+		}
+		CategoryNames[axis][cat] = desc
+	}
+}
+
+// resolveCategories returns the non-zero category values as a list of
+// named categories. Codes missing from the categories table are described
+// by their number.
+func resolveCategories(cats ...int) []Category {
+
+	var res []Category
+	for i, cat := range cats {
+		if cat == 0 {
+			continue
+		}
+		axis := i + 1
+		desc, ok := CategoryNames[axis][cat]
+		if !ok {
+			desc = strconv.Itoa(cat)
+		}
+		res = append(res, Category{Axis: axis, AxisName: AxisNames[axis], Cat: cat, BriefDesc: desc})
+	}
+	return res
+}
+
+// categoryOn returns the description of the category on the given axis
+func categoryOn(cats []Category, axis int) string {
+
+	for _, c := range cats {
+		if c.Axis == axis {
+			return c.BriefDesc
+		}
+	}
+	return ""
+}
+
+// CatName returns the category description on the given axis, for use in
+// templates as {{.CatName 1}}
+func (b *Bonus) CatName(axis int) string {
+
+	return categoryOn(b.Categories, axis)
+}
+
+// CatName returns the category description on the given axis, for use in
+// templates as {{.CatName 1}}
+func (b *Combo) CatName(axis int) string {
+
+	return categoryOn(b.Categories, axis)
+}
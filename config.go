@@ -61,6 +61,14 @@ const type_entrant = "entrant"
 // const type_static = "static"
 const stream_prefix = "stream"
 
+// Built-in sections are identified by this prefix, eg rbook.toc, so that
+// they can't be mistaken for a project's static templates
+const builtin_prefix = "rbook"
+const toc_section = "toc"
+const index_section = "index"
+const map_section = "map"
+const distance_section = "distances"
+
 //go:embed css/reboot.css
 var css_reboot string
 
@@ -70,6 +78,24 @@ var css_a4portrait string
 //go:embed css/a4landscape.css
 var css_a4landscape string
 
+//go:embed css/a5portrait.css
+var css_a5portrait string
+
+//go:embed css/a5landscape.css
+var css_a5landscape string
+
+//go:embed css/letterportrait.css
+var css_letterportrait string
+
+//go:embed css/letterlandscape.css
+var css_letterlandscape string
+
+//go:embed css/legalportrait.css
+var css_legalportrait string
+
+//go:embed css/legallandscape.css
+var css_legallandscape string
+
 type BonusStream struct {
 	StreamID     string `yaml:"streamid"`
 	Type         string `yaml:"type"` // bonus, combo, static
@@ -80,31 +106,63 @@ type BonusStream struct {
 	TemplateID   string `yaml:"template"`
 	NoPageTop    bool   `yaml:"noPageTop"`
 	EmitGPX      bool   `yaml:"emitGPX"`
+	GroupBy      string `yaml:"groupBy"`      // field name or Cat1 - Cat9
+	GroupHeader  string `yaml:"groupHeader"`  // template emitted before each group
+	GroupNewPage bool   `yaml:"groupNewPage"` // start each group on a new page
+	CharsPerRow  int    `yaml:"charsPerRow"`  // notes & waffle overflowing a row
+	Title        string `yaml:"title"`        // table of contents entry
+	NoIndex      bool   `yaml:"noIndex"`      // leave out of the bonus index
+	GPXRoute     bool   `yaml:"gpxRoute"`     // also a GPX route in stream order
+	RouteName    string `yaml:"routeName"`
+	RouteDesc    string `yaml:"routeDesc"`
+	GPXFile      string `yaml:"gpxFile"`      // own GPX file instead of the main one
+	GPXSplitBy   string `yaml:"gpxSplitBy"`   // a file for each value of this field
+	CoordsFormat string `yaml:"coordsFormat"` // print Coords in this notation
+	LocatorMaps  bool   `yaml:"locatorMaps"`  // draw a map of each bonus
 }
 
 var CFG struct {
-	Title               string        `yaml:"title"`
-	Description         string        `yaml:"description"`
-	ProjectFolder       string        `yaml:"projectFolder"`
-	OutputFolder        string        `yaml:"outputFolder"`
-	OutputFile          string        `yaml:"rallybookFile"`
-	GPX                 GPXParams     `yaml:"generateGPX"`
-	Database            string        `yaml:"database"`
-	ImageFolder         string        `yaml:"imageFolder"`
-	Sections            []string      `yaml:"sections"`
-	Streams             []BonusStream `yaml:"streams"`
-	Landscape           bool          `yaml:"landscape"`
-	BonusSQL            string        `yaml:"bonusSQL"`
-	ComboSQL            string        `yaml:"comboSQL"`
-	EntrantSQL          string        `yaml:"entrantSQL"`
-	AskPointsVarPrefix  string        `yaml:"askPointsVariablePrefix"`
-	AskPointsMultPrefix string        `yaml:"askPointsMultiplierPrefix"`
+	Title               string            `yaml:"title"`
+	Description         string            `yaml:"description"`
+	ProjectFolder       string            `yaml:"projectFolder"`
+	OutputFolder        string            `yaml:"outputFolder"`
+	OutputFile          string            `yaml:"rallybookFile"`
+	GPX                 GPXParams         `yaml:"generateGPX"`
+	PDF                 PDFParams         `yaml:"generatePDF"`
+	KML                 KMLParams         `yaml:"generateKML"`
+	GeoJSON             GeoJSONParams     `yaml:"generateGeoJSON"`
+	POI                 POIParams         `yaml:"generatePOI"`
+	Validate            ValidateParams    `yaml:"validateCoords"`
+	CoordsInput         CoordsInputParams `yaml:"coordsInput"`
+	Map                 MapParams         `yaml:"map"`
+	Locator             LocatorParams     `yaml:"locatorMap"`
+	Distances           DistanceParams    `yaml:"distances"`
+	Route               RouteParams       `yaml:"route"`
+	Daylight            DaylightParams    `yaml:"daylight"`
+	Database            string            `yaml:"database"`
+	ImageFolder         string            `yaml:"imageFolder"`
+	Sections            []string          `yaml:"sections"`
+	Streams             []BonusStream     `yaml:"streams"`
+	Landscape           bool              `yaml:"landscape"`
+	Paper               PaperParams       `yaml:"paper"`
+	BonusSQL            string            `yaml:"bonusSQL"`
+	ComboSQL            string            `yaml:"comboSQL"`
+	EntrantSQL          string            `yaml:"entrantSQL"`
+	CategorySQL         string            `yaml:"categorySQL"`
+	AxisSQL             string            `yaml:"axisSQL"`
+	AskPointsVarPrefix  string            `yaml:"askPointsVariablePrefix"`
+	AskPointsMultPrefix string            `yaml:"askPointsMultiplierPrefix"`
+	PageHeader          string            `yaml:"pageHeader"`
+	PageFooter          string            `yaml:"pageFooter"`
+	TocLinesPerPage     int               `yaml:"tocLinesPerPage"`
+	IndexLinesPerPage   int               `yaml:"indexLinesPerPage"`
 }
 
 type Bonus struct {
 	BonusID                                                string
 	BriefDesc                                              string
 	Points                                                 string
+	PointsValue                                            int
 	Flags                                                  string
 	Notes                                                  string
 	Waffle                                                 string
@@ -119,6 +177,7 @@ type Bonus struct {
 	Cat7                                                   int
 	Cat8                                                   int
 	Cat9                                                   int
+	Categories                                             []Category
 	NewLine                                                bool
 	StreamID                                               string
 	ImageFolder                                            string
@@ -130,10 +189,29 @@ type Bonus struct {
 	AskPoints                                              bool
 	Lat                                                    float64
 	Lon                                                    float64
+	ValidCoords                                            bool
+	coordsErr                                              error
+	OriginalCoords                                         string // as entered
+	MapImage                                               string // locator map
+	PageNumber                                             int
+	Anchor                                                 string
 }
 type ComboBonus struct {
-	BonusID   string
-	BriefDesc string
+	BonusID                                                string
+	BriefDesc                                              string
+	Points                                                 string
+	PointsValue                                            int
+	Flags                                                  string
+	Coords                                                 string
+	Image                                                  string
+	ImageFolder                                            string
+	Categories                                             []Category
+	AlertT, AlertR, AlertF, AlertB, AlertD, AlertA, AlertN bool
+	PageNumber                                             int
+	Anchor                                                 string
+	Lat                                                    float64
+	Lon                                                    float64
+	ValidCoords                                            bool
 }
 type Combo struct {
 	ComboID      string
@@ -152,9 +230,11 @@ type Combo struct {
 	Cat7         int
 	Cat8         int
 	Cat9         int
+	Categories   []Category
 	Compulsory   bool
 	NewLine      bool
 	StreamID     string
+	PageNumber   int
 }
 
 type Entrant struct {
@@ -168,6 +248,7 @@ type Entrant struct {
 	NewLine     bool
 	StreamID    string
 	ImageFolder string
+	PageNumber  int
 }
 
 func newBonus() *Bonus {
@@ -197,6 +278,27 @@ func newCombo() *Combo {
 
 }
 
+func newComboBonus(b *Bonus) ComboBonus {
+
+	var cb ComboBonus
+
+	cb.BonusID = b.BonusID
+	cb.BriefDesc = b.BriefDesc
+	cb.Points = b.Points
+	cb.PointsValue = b.PointsValue
+	cb.Flags = b.Flags
+	cb.Coords = b.Coords
+	cb.Image = b.Image
+	cb.ImageFolder = b.ImageFolder
+	cb.Categories = b.Categories
+	cb.AlertT, cb.AlertR, cb.AlertF, cb.AlertB = b.AlertT, b.AlertR, b.AlertF, b.AlertB
+	cb.AlertD, cb.AlertA, cb.AlertN = b.AlertD, b.AlertA, b.AlertN
+	cb.Lat, cb.Lon, cb.ValidCoords = b.Lat, b.Lon, b.ValidCoords
+
+	return cb
+
+}
+
 func newEntrant() *Entrant {
 
 	var e Entrant
@@ -240,5 +342,22 @@ func loadConfig() {
 	if *outputGPX == "" {
 		*outputGPX = CFG.GPX.OutputGPX
 	}
+
+	if *outputPDF == "" {
+		*outputPDF = CFG.PDF.OutputPDF
+	}
+
+	if *outputKML == "" {
+		*outputKML = CFG.KML.OutputKML
+	}
+
+	if *outputGeoJSON == "" {
+		*outputGeoJSON = CFG.GeoJSON.OutputGeoJSON
+	}
+
+	setupPaper()
+	setupGPX()
+	setupCoordsFormats()
+	setupCoordsInput()
 	//fmt.Printf("CFG now reads %v\n\n", CFG.ImageFolder)
 }
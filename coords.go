@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// Coordinates may be printed in any of these notations, worked out from the
+// parsed latitude and longitude rather than the text typed in ScoreMaster.
+const (
+	coords_dd   = "dd"   // 53.20155, -0.30513
+	coords_dms  = "dms"  // 53°12'05.6"N 0°18'18.5"W
+	coords_ddm  = "ddm"  // N53°12.093' W0°18.308'
+	coords_osgb = "osgb" // TF 13308 68504
+	coords_utm  = "utm"  // 30U 679991 5898082
+	coords_mgrs = "mgrs" // 30U XD 79991 98082
+)
+
+var coordsNotations = []string{coords_dd, coords_dms, coords_ddm, coords_osgb, coords_utm, coords_mgrs}
+
+// ellipsoid holds the semi-major and semi-minor axes, in metres
+type ellipsoid struct {
+	a, b float64
+}
+
+var wgs84 = ellipsoid{6378137, 6356752.314245}
+var airy1830 = ellipsoid{6377563.396, 6356256.909}
+
+// transverseMercator describes a projection, angles in degrees
+type transverseMercator struct {
+	ell        ellipsoid
+	f0         float64 // scale on the central meridian
+	lat0, lon0 float64 // true origin
+	e0, n0     float64 // false origin
+}
+
+var osgbGrid = transverseMercator{airy1830, 0.9996012717, 49, -2, 400000, -100000}
+
+// helmert holds the parameters of a 7 parameter datum transformation:
+// translations in metres, scale in ppm and rotations in arc seconds
+type helmert struct {
+	tx, ty, tz, s, rx, ry, rz float64
+}
+
+var wgs84ToOSGB36 = helmert{-446.448, 125.157, -542.060, 20.4894, -0.1502, -0.2470, -0.8421}
+
+const rad = math.Pi / 180
+
+// setupCoordsFormats checks the coordsFormat of every stream
+func setupCoordsFormats() {
+
+	for i := range CFG.Streams {
+		st := &CFG.Streams[i]
+		st.CoordsFormat = strings.ToLower(st.CoordsFormat)
+		if st.CoordsFormat != "" && !validNotation(st.CoordsFormat) {
+			fmt.Printf("Stream %v: unknown coordsFormat %v, use one of %v\n", st.StreamID, st.CoordsFormat,
+				strings.Join(coordsNotations, ", "))
+			os.Exit(1)
+		}
+	}
+}
+
+func validNotation(notation string) bool {
+
+	for _, n := range coordsNotations {
+		if n == notation {
+			return true
+		}
+	}
+	return false
+}
+
+// CoordsIn is available to templates as {{.CoordsIn "osgb"}}, giving the
+// bonus's position in the notation named or "" if it can't be expressed so
+func (B *Bonus) CoordsIn(notation string) string {
+
+	if !B.ValidCoords {
+		return ""
+	}
+	return formatCoords(B.Lat, B.Lon, notation)
+}
+
+// formatCoords returns the position in the notation named
+func formatCoords(lat, lon float64, notation string) string {
+
+	switch strings.ToLower(notation) {
+	case coords_dd:
+		return fmt.Sprintf("%.5f, %.5f", lat, lon)
+	case coords_dms:
+		return dmsString(lat, "N", "S") + " " + dmsString(lon, "E", "W")
+	case coords_ddm:
+		return ddmString(lat, "N", "S") + " " + ddmString(lon, "E", "W")
+	case coords_osgb:
+		return osgbGridRef(lat, lon)
+	case coords_utm:
+		zone, band, e, n := utmPosition(lat, lon)
+		if band == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%d%c %.0f %.0f", zone, band, math.Floor(e), math.Floor(n))
+	case coords_mgrs:
+		return mgrsString(lat, lon)
+	}
+	return ""
+}
+
+// hemisphere returns the absolute value of x with the letter for its sign
+func hemisphere(x float64, pos string, neg string) (float64, string) {
+
+	if x < 0 {
+		return -x, neg
+	}
+	return x, pos
+}
+
+func dmsString(x float64, pos string, neg string) string {
+
+	x, h := hemisphere(x, pos, neg)
+	tenths := math.Round(x * 36000) // tenths of a second
+	d := math.Floor(tenths / 36000)
+	m := math.Floor((tenths - d*36000) / 600)
+	s := (tenths - d*36000 - m*600) / 10
+	return fmt.Sprintf("%.0f°%02.0f'%04.1f\"%v", d, m, s, h)
+}
+
+func ddmString(x float64, pos string, neg string) string {
+
+	x, h := hemisphere(x, pos, neg)
+	thous := math.Round(x * 60000) // thousandths of a minute
+	d := math.Floor(thous / 60000)
+	m := (thous - d*60000) / 1000
+	return fmt.Sprintf("%v%.0f°%.3f'", h, d, m)
+}
+
+// toCartesian returns the geocentric position of a point on the ellipsoid
+func toCartesian(lat, lon float64, ell ellipsoid) (float64, float64, float64) {
+
+	phi, lambda := lat*rad, lon*rad
+	e2 := 1 - ell.b*ell.b/(ell.a*ell.a)
+	nu := ell.a / math.Sqrt(1-e2*math.Sin(phi)*math.Sin(phi))
+	return nu * math.Cos(phi) * math.Cos(lambda), nu * math.Cos(phi) * math.Sin(lambda), nu * (1 - e2) * math.Sin(phi)
+}
+
+// fromCartesian returns the latitude and longitude of a geocentric position
+func fromCartesian(x, y, z float64, ell ellipsoid) (float64, float64) {
+
+	e2 := 1 - ell.b*ell.b/(ell.a*ell.a)
+	p := math.Sqrt(x*x + y*y)
+	phi := math.Atan2(z, p*(1-e2))
+	for i := 0; i < 10; i++ {
+		nu := ell.a / math.Sqrt(1-e2*math.Sin(phi)*math.Sin(phi))
+		phi = math.Atan2(z+e2*nu*math.Sin(phi), p)
+	}
+	return phi / rad, math.Atan2(y, x) / rad
+}
+
+// transform converts a position between datums, inverting the parameters if
+// reverse is set
+func (h helmert) transform(lat, lon float64, from ellipsoid, to ellipsoid, reverse bool) (float64, float64) {
+
+	sign := 1.0
+	if reverse {
+		sign = -1
+	}
+	x, y, z := toCartesian(lat, lon, from)
+	s := 1 + sign*h.s*1e-6
+	sec := rad / 3600
+	rx, ry, rz := sign*h.rx*sec, sign*h.ry*sec, sign*h.rz*sec
+	x2 := sign*h.tx + s*x - rz*y + ry*z
+	y2 := sign*h.ty + rz*x + s*y - rx*z
+	z2 := sign*h.tz - ry*x + rx*y + s*z
+	return fromCartesian(x2, y2, z2, to)
+}
+
+// meridionalArc returns the distance from the true origin to latitude phi,
+// in radians, along the central meridian
+func (tm transverseMercator) meridionalArc(phi float64) float64 {
+
+	a, b := tm.ell.a, tm.ell.b
+	n := (a - b) / (a + b)
+	n2, n3 := n*n, n*n*n
+	phi0 := tm.lat0 * rad
+	dp, sp := phi-phi0, phi+phi0
+	return b * tm.f0 * ((1+n+5.0/4*n2+5.0/4*n3)*dp -
+		(3*n+3*n2+21.0/8*n3)*math.Sin(dp)*math.Cos(sp) +
+		(15.0/8*n2+15.0/8*n3)*math.Sin(2*dp)*math.Cos(2*sp) -
+		35.0/24*n3*math.Sin(3*dp)*math.Cos(3*sp))
+}
+
+// radii returns the radii of curvature, nu and rho, at latitude phi
+func (tm transverseMercator) radii(phi float64) (float64, float64) {
+
+	a, b := tm.ell.a, tm.ell.b
+	e2 := 1 - b*b/(a*a)
+	sin2 := math.Sin(phi) * math.Sin(phi)
+	nu := a * tm.f0 / math.Sqrt(1-e2*sin2)
+	rho := a * tm.f0 * (1 - e2) / math.Pow(1-e2*sin2, 1.5)
+	return nu, rho
+}
+
+// project returns the easting and northing of a position, following the
+// Ordnance Survey's 'A guide to coordinate systems in Great Britain'
+func (tm transverseMercator) project(lat, lon float64) (float64, float64) {
+
+	phi := lat * rad
+	dl := (lon - tm.lon0) * rad
+	nu, rho := tm.radii(phi)
+	eta2 := nu/rho - 1
+	sin, cos, tan := math.Sin(phi), math.Cos(phi), math.Tan(phi)
+	tan2, tan4 := tan*tan, tan*tan*tan*tan
+	cos3, cos5 := cos*cos*cos, cos*cos*cos*cos*cos
+
+	I := tm.meridionalArc(phi) + tm.n0
+	II := nu / 2 * sin * cos
+	III := nu / 24 * sin * cos3 * (5 - tan2 + 9*eta2)
+	IIIA := nu / 720 * sin * cos5 * (61 - 58*tan2 + tan4)
+	IV := nu * cos
+	V := nu / 6 * cos3 * (nu/rho - tan2)
+	VI := nu / 120 * cos5 * (5 - 18*tan2 + tan4 + 14*eta2 - 58*tan2*eta2)
+
+	n := I + II*dl*dl + III*math.Pow(dl, 4) + IIIA*math.Pow(dl, 6)
+	e := tm.e0 + IV*dl + V*math.Pow(dl, 3) + VI*math.Pow(dl, 5)
+	return e, n
+}
+
+// unproject returns the latitude and longitude of an easting and northing
+func (tm transverseMercator) unproject(e, n float64) (float64, float64) {
+
+	phi := (n-tm.n0)/(tm.ell.a*tm.f0) + tm.lat0*rad
+	for i := 0; i < 20; i++ {
+		d := n - tm.n0 - tm.meridionalArc(phi)
+		if math.Abs(d) < 0.00001 {
+			break
+		}
+		phi += d / (tm.ell.a * tm.f0)
+	}
+	nu, rho := tm.radii(phi)
+	eta2 := nu/rho - 1
+	tan := math.Tan(phi)
+	tan2, tan4, tan6 := tan*tan, math.Pow(tan, 4), math.Pow(tan, 6)
+	sec := 1 / math.Cos(phi)
+
+	VII := tan / (2 * rho * nu)
+	VIII := tan / (24 * rho * math.Pow(nu, 3)) * (5 + 3*tan2 + eta2 - 9*tan2*eta2)
+	IX := tan / (720 * rho * math.Pow(nu, 5)) * (61 + 90*tan2 + 45*tan4)
+	X := sec / nu
+	XI := sec / (6 * math.Pow(nu, 3)) * (nu/rho + 2*tan2)
+	XII := sec / (120 * math.Pow(nu, 5)) * (5 + 28*tan2 + 24*tan4)
+	XIIA := sec / (5040 * math.Pow(nu, 7)) * (61 + 662*tan2 + 1320*tan4 + 720*tan6)
+
+	de := e - tm.e0
+	lat := phi - VII*de*de + VIII*math.Pow(de, 4) - IX*math.Pow(de, 6)
+	lon := tm.lon0*rad + X*de - XI*math.Pow(de, 3) + XII*math.Pow(de, 5) - XIIA*math.Pow(de, 7)
+	return lat / rad, lon / rad
+}
+
+// osgbEastingNorthing returns the British National Grid position of a WGS84
+// latitude and longitude, accurate to a few metres
+func osgbEastingNorthing(lat, lon float64) (float64, float64) {
+
+	lat, lon = wgs84ToOSGB36.transform(lat, lon, wgs84, airy1830, false)
+	return osgbGrid.project(lat, lon)
+}
+
+// osgbGridRef returns the 10 figure OS grid reference of a position or "" if
+// it's outside the National Grid
+func osgbGridRef(lat, lon float64) string {
+
+	e, n := osgbEastingNorthing(lat, lon)
+	if e < 0 || e >= 700000 || n < 0 || n >= 1300000 {
+		return ""
+	}
+	e100k, n100k := int(e/100000), int(n/100000)
+	l1 := (19 - n100k) - (19-n100k)%5 + (e100k+10)/5
+	l2 := (19-n100k)*5%25 + e100k%5
+	if l1 > 7 {
+		l1++ // no I
+	}
+	if l2 > 7 {
+		l2++
+	}
+	return fmt.Sprintf("%c%c %05d %05d", 'A'+l1, 'A'+l2, int(e)%100000, int(n)%100000)
+}
+
+const utmBands = "CDEFGHJKLMNPQRSTUVWXX"
+
+// utmPosition returns the UTM zone, latitude band, easting and northing of a
+// position, with a band of 0 outside the UTM latitudes
+func utmPosition(lat, lon float64) (int, byte, float64, float64) {
+
+	if lat < -80 || lat > 84 {
+		return 0, 0, 0, 0
+	}
+	if lon >= 180 {
+		lon -= 360 // the antimeridian is the west edge of zone 1
+	}
+	zone := int(math.Floor((lon+180)/6)) + 1
+	band := utmBands[int(math.Floor(lat/8+10))]
+	switch {
+	case band == 'V' && zone == 31 && lon >= 3: // Norway
+		zone = 32
+	case band == 'X' && lon >= 0 && lon < 42: // Svalbard
+		zone = 31 + 2*int((lon+3)/12)
+	}
+	tm := transverseMercator{wgs84, 0.9996, 0, float64(zone*6 - 183), 500000, 0}
+	e, n := tm.project(lat, lon)
+	if lat < 0 {
+		n += 10000000
+	}
+	return zone, band, e, n
+}
+
+// mgrsString returns the 10 figure MGRS reference of a position
+func mgrsString(lat, lon float64) string {
+
+	zone, band, e, n := utmPosition(lat, lon)
+	if band == 0 {
+		return ""
+	}
+	cols := []string{"STUVWXYZ", "ABCDEFGH", "JKLMNPQR"}[zone%3]
+	rows := "ABCDEFGHJKLMNPQRSTUV"
+	cx := int(e/100000) - 1
+	if cx < 0 || cx >= len(cols) {
+		return ""
+	}
+	col := cols[cx]
+	r := int(n/100000) % 20
+	if zone%2 == 0 {
+		r = (r + 5) % 20
+	}
+	return fmt.Sprintf("%d%c %c%c %05d %05d", zone, band, col, rows[r], int(e)%100000, int(n)%100000)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// dms returns decimal degrees
+func dms(d, m, s float64) float64 {
+
+	return d + m/60 + s/3600
+}
+
+// The worked example in the Ordnance Survey's "A guide to coordinate systems
+// in Great Britain", annex C
+func TestOSGBProjection(t *testing.T) {
+
+	lat, lon := dms(52, 39, 27.2531), dms(1, 43, 4.5177)
+	e, n := osgbGrid.project(lat, lon)
+	if math.Abs(e-651409.903) > 0.001 || math.Abs(n-313177.270) > 0.001 {
+		t.Errorf("project got %.3f, %.3f, want 651409.903, 313177.270", e, n)
+	}
+	lat2, lon2 := osgbGrid.unproject(651409.903, 313177.270)
+	if math.Abs(lat2-lat) > 1e-8 || math.Abs(lon2-lon) > 1e-8 {
+		t.Errorf("unproject got %.9f, %.9f, want %.9f, %.9f", lat2, lon2, lat, lon)
+	}
+}
+
+func TestHelmert(t *testing.T) {
+
+	// The Airy transit circle at Greenwich is on the OSGB36 prime meridian
+	// but about 100m east of the WGS84 one. The transformation is good to a
+	// few metres.
+	_, lon := wgs84ToOSGB36.transform(51.477811, -0.001475, wgs84, airy1830, false)
+	if math.Abs(lon) > 0.0003 {
+		t.Errorf("Greenwich OSGB36 longitude %.6f, want 0", lon)
+	}
+
+	for _, p := range [][2]float64{{50.0, -5.5}, {53.20155, -0.30513}, {58.6, -3.1}} {
+		lat, lon := wgs84ToOSGB36.transform(p[0], p[1], wgs84, airy1830, false)
+		lat, lon = wgs84ToOSGB36.transform(lat, lon, airy1830, wgs84, true)
+		if math.Abs(lat-p[0]) > 1e-6 || math.Abs(lon-p[1]) > 1e-6 {
+			t.Errorf("round trip of %v gave %.7f, %.7f", p, lat, lon)
+		}
+	}
+}
+
+func TestUTM(t *testing.T) {
+
+	tests := []struct {
+		lat, lon float64
+		zone     int
+		band     byte
+		e, n     float64
+	}{
+		{0, 0, 31, 'N', 166021.443, 0},                   // Null Island
+		{0, 3, 31, 'N', 500000, 0},                       // central meridian
+		{45, -3, 30, 'T', 500000, 4982950.400},           // meridian arc 4984944.378m
+		{-33.9, 151.2, 56, 'H', 333568.941, 6247473.337}, // Sydney
+		{60.5, 5.5, 32, 'V', 0, 0},                       // Norway exception
+	}
+	for _, tc := range tests {
+		zone, band, e, n := utmPosition(tc.lat, tc.lon)
+		if zone != tc.zone || band != tc.band {
+			t.Errorf("%v, %v zone %v%c, want %v%c", tc.lat, tc.lon, zone, band, tc.zone, tc.band)
+			continue
+		}
+		if tc.e == 0 {
+			continue
+		}
+		if math.Abs(e-tc.e) > 0.01 || math.Abs(n-tc.n) > 0.01 {
+			t.Errorf("%v, %v gave %.3f, %.3f, want %v, %v", tc.lat, tc.lon, e, n, tc.e, tc.n)
+		}
+	}
+}
+
+func TestFormatCoords(t *testing.T) {
+
+	tests := []struct {
+		lat, lon float64
+		notation string
+		want     string
+	}{
+		{0, 0, coords_mgrs, "31N AA 66021 00000"},
+		{53.20155, -0.30513, coords_dd, "53.20155, -0.30513"},
+		{53.20155, -0.30513, coords_dms, `53°12'05.6"N 0°18'18.5"W`},
+		{53.20155, -0.30513, coords_ddm, "N53°12.093' W0°18.308'"},
+		{53.20155, -0.30513, coords_osgb, "TF 13308 68504"},
+		{53.20155, -0.30513, coords_utm, "30U 679991 5898082"},
+		{53.20155, -0.30513, coords_mgrs, "30U XD 79991 98082"},
+		{40, -40, coords_osgb, ""},                  // off the grid
+		{10, 180, coords_mgrs, "1P AM 71071 06908"}, // the antimeridian
+	}
+	for _, tc := range tests {
+		if got := formatCoords(tc.lat, tc.lon, tc.notation); got != tc.want {
+			t.Errorf("%v, %v as %v = %q, want %q", tc.lat, tc.lon, tc.notation, got, tc.want)
+		}
+	}
+}
+
+func TestOSGBGridRef(t *testing.T) {
+
+	// The OS example point, from OSGB36 to WGS84 and back to the grid
+	lat, lon := wgs84ToOSGB36.transform(dms(52, 39, 27.2531), dms(1, 43, 4.5177), airy1830, wgs84, true)
+	if got := osgbGridRef(lat, lon); got != "TG 51409 13177" {
+		t.Errorf("osgbGridRef = %q, want TG 51409 13177", got)
+	}
+}
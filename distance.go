@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// DistanceParams configures the great circle distances between bonuses
+// offered to templates and printed by 'rbook.distances.streamid' sections
+type DistanceParams struct {
+	Units      string `yaml:"units"`      // miles or km, default from rallyparams
+	Neighbours int    `yaml:"neighbours"` // number listed by .Neighbours, default 5
+	Title      string `yaml:"title"`      // of the distance matrix
+	CSVFile    string `yaml:"csvFile"`    // matrix of every bonus
+}
+
+const units_miles = "miles"
+const units_km = "km"
+const metresPerMile = 1609.344
+const defaultNeighbours = 5
+
+// smKms is the value of rallyparams.MilesKms for a rally measured in km
+const smKms = 1
+
+// Neighbour is one of the bonuses nearest another
+type Neighbour struct {
+	BonusID   string
+	BriefDesc string
+	Anchor    string
+	Distance  float64 // rounded to 0.1
+	Units     string
+}
+
+// DistanceRow is one bonus's line of the distance matrix
+type DistanceRow struct {
+	BonusID   string
+	BriefDesc string
+	Distances []string // to each bonus in turn, blank for itself
+}
+
+// DistancePage is passed to the distance matrix template
+type DistancePage struct {
+	Title    string
+	StreamID string
+	Units    string
+	IDs      []string
+	Rows     []DistanceRow
+}
+
+const distanceTemplate = `
+<div class="page distances">
+<h3>{{.Title}}</h3>
+<table class="distances">
+<tr><th>{{.Units}}</th>{{range .IDs}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr><th title="{{.BriefDesc}}">{{.BonusID}}</th>{{range .Distances}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+</div>
+`
+
+var distanceUnitsName string
+
+// distanceUnits returns the units of the rally, miles or km, as configured
+// or else as set in ScoreMaster
+func distanceUnits() string {
+
+	if distanceUnitsName != "" {
+		return distanceUnitsName
+	}
+	switch CFG.Distances.Units {
+	case units_miles, units_km:
+		distanceUnitsName = CFG.Distances.Units
+	case "":
+		distanceUnitsName = units_miles
+		if getStringFromDB("SELECT MilesKms FROM rallyparams", "0") == strconv.Itoa(smKms) {
+			distanceUnitsName = units_km
+		}
+	default:
+		fmt.Printf("Distance units must be %v or %v, not %v\n", units_miles, units_km, CFG.Distances.Units)
+		distanceUnitsName = units_miles
+	}
+	return distanceUnitsName
+}
+
+// distanceBetween returns the great circle distance between two bonuses in
+// the rally's units
+func distanceBetween(a, b *Bonus) float64 {
+
+	m := distanceMetres(a.Lat, a.Lon, b.Lat, b.Lon)
+	if distanceUnits() == units_km {
+		return m / 1000
+	}
+	return m / metresPerMile
+}
+
+// mappableBonuses returns every bonus in the database with usable
+// coordinates, in BonusID order
+func mappableBonuses() []*Bonus {
+
+	if BonusTable == nil {
+		loadBonusTable()
+	}
+	var res []*Bonus
+	for _, B := range BonusTable {
+		if B.ValidCoords {
+			res = append(res, B)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return lessBonusID(res[i].BonusID, res[j].BonusID) })
+	return res
+}
+
+// Nearest is available to templates as {{.Nearest 3}}, giving the n bonuses
+// nearest this one, nearest first. Bonuses at the same position, such as
+// duplicates, are included.
+func (B *Bonus) Nearest(n int) []Neighbour {
+
+	if !B.ValidCoords || n < 1 {
+		return nil
+	}
+	var res []Neighbour
+	for _, N := range mappableBonuses() {
+		if N.BonusID == B.BonusID {
+			continue
+		}
+		res = append(res, Neighbour{BonusID: N.BonusID, BriefDesc: N.BriefDesc, Anchor: N.Anchor, Distance: distanceBetween(B, N), Units: distanceUnits()})
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Distance < res[j].Distance })
+	res = res[:min(n, len(res))]
+	for i := range res {
+		res[i].Distance = roundDistance(res[i].Distance)
+	}
+	return res
+}
+
+// Neighbours is available to templates as {{.Neighbours}}, the configured
+// number of nearest bonuses
+func (B *Bonus) Neighbours() []Neighbour {
+
+	n := CFG.Distances.Neighbours
+	if n < 1 {
+		n = defaultNeighbours
+	}
+	return B.Nearest(n)
+}
+
+func roundDistance(d float64) float64 {
+
+	return float64(int(d*10+0.5)) / 10
+}
+
+// distanceMatrix returns the distances between each pair of bonuses
+func distanceMatrix(bonuses []*Bonus) []DistanceRow {
+
+	var res []DistanceRow
+	for _, a := range bonuses {
+		row := DistanceRow{BonusID: a.BonusID, BriefDesc: a.BriefDesc}
+		for _, b := range bonuses {
+			d := ""
+			if a != b {
+				d = strconv.FormatFloat(roundDistance(distanceBetween(a, b)), 'f', 1, 64)
+			}
+			row.Distances = append(row.Distances, d)
+		}
+		res = append(res, row)
+	}
+	return res
+}
+
+// emitDistances adds the distance matrix of the stream named in sf to the
+// book
+func emitDistances(sf []string) {
+
+	if len(sf) < 2 {
+		fmt.Println("A distances section must name a stream, eg rbook.distances.bonuses")
+		return
+	}
+	for sx, v := range CFG.Streams {
+		if v.StreamID != sf[1] || v.Type == type_combo || v.Type == type_entrant {
+			continue
+		}
+		pg := DistancePage{Title: CFG.Distances.Title, StreamID: v.StreamID, Units: distanceUnits()}
+		if pg.Title == "" {
+			pg.Title = "Distances between bonuses"
+		}
+		var bonuses []*Bonus
+		for _, B := range fetchBonuses(sx) {
+			if B.ValidCoords {
+				bonuses = append(bonuses, B)
+				pg.IDs = append(pg.IDs, B.BonusID)
+			}
+		}
+		pg.Rows = distanceMatrix(bonuses)
+		t := builtinTemplate(builtinTemplateName(distance_section), distanceTemplate)
+		err := OUTF.execute(t, pg)
+		if err != nil {
+			fmt.Printf("distances %v\n", err)
+		}
+	}
+}
+
+// emitDistanceCSV writes the distance matrix of every bonus with usable
+// coordinates
+func emitDistanceCSV(path string) {
+
+	bonuses := mappableBonuses()
+	F, err := os.Create(path)
+	checkerr(err)
+	defer F.Close()
+	w := csv.NewWriter(F)
+	hdr := []string{distanceUnits()}
+	for _, B := range bonuses {
+		hdr = append(hdr, B.BonusID)
+	}
+	w.Write(hdr)
+	for _, row := range distanceMatrix(bonuses) {
+		w.Write(append([]string{row.BonusID}, row.Distances...))
+	}
+	w.Flush()
+	checkerr(w.Error())
+	fmt.Printf("Generating %v, distances between %v bonuses\n", path, len(bonuses))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const earthRadiusMetres = 6371008.8
+
+// distanceMetres returns the great circle distance between two points
+func distanceMetres(lat1, lon1, lat2, lon2 float64) float64 {
+
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadiusMetres * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// Ring is a closed line of [longitude, latitude] positions, as in GeoJSON
+type Ring [][2]float64
+
+// geoJSONObject is just enough of any GeoJSON object to find its polygons
+type geoJSONObject struct {
+	Type        string            `json:"type"`
+	Features    []json.RawMessage `json:"features"`
+	Geometry    json.RawMessage   `json:"geometry"`
+	Geometries  []json.RawMessage `json:"geometries"`
+	Coordinates json.RawMessage   `json:"coordinates"`
+}
+
+// loadPolygons returns the rings of every Polygon and MultiPolygon in a
+// GeoJSON file, outer boundaries and holes alike
+func loadPolygons(path string) ([]Ring, error) {
+
+	return loadGeoJSON(path, false)
+}
+
+// loadOutlines returns the rings of the polygons and the lines of a GeoJSON
+// file or ESRI shapefile, for drawing
+func loadOutlines(path string) ([]Ring, error) {
+
+	if strings.EqualFold(filepath.Ext(path), ".shp") {
+		return loadShapefile(path)
+	}
+	return loadGeoJSON(path, true)
+}
+
+func loadGeoJSON(path string, lines bool) ([]Ring, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var res []Ring
+	err = appendPolygons(data, &res, lines)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return res, nil
+}
+
+// appendPolygons adds the rings of any polygons in data to res, and the
+// lines too if lines is set
+func appendPolygons(data []byte, res *[]Ring, lines bool) error {
+
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	var obj geoJSONObject
+	err := json.Unmarshal(data, &obj)
+	if err != nil {
+		return err
+	}
+	switch obj.Type {
+	case "FeatureCollection":
+		for _, f := range obj.Features {
+			if err := appendPolygons(f, res, lines); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		return appendPolygons(obj.Geometry, res, lines)
+	case "GeometryCollection":
+		for _, g := range obj.Geometries {
+			if err := appendPolygons(g, res, lines); err != nil {
+				return err
+			}
+		}
+	case "Polygon":
+		var rings []Ring
+		if err := json.Unmarshal(obj.Coordinates, &rings); err != nil {
+			return err
+		}
+		*res = append(*res, rings...)
+	case "MultiPolygon":
+		var polys [][]Ring
+		if err := json.Unmarshal(obj.Coordinates, &polys); err != nil {
+			return err
+		}
+		for _, rings := range polys {
+			*res = append(*res, rings...)
+		}
+	case "LineString":
+		if !lines {
+			break
+		}
+		var line Ring
+		if err := json.Unmarshal(obj.Coordinates, &line); err != nil {
+			return err
+		}
+		*res = append(*res, line)
+	case "MultiLineString":
+		if !lines {
+			break
+		}
+		var ml []Ring
+		if err := json.Unmarshal(obj.Coordinates, &ml); err != nil {
+			return err
+		}
+		*res = append(*res, ml...)
+	}
+	return nil
+}
+
+// loadShapefile returns the parts of every polyline and polygon in an ESRI
+// shapefile, whose coordinates must be longitude and latitude
+func loadShapefile(path string) ([]Ring, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 100 || binary.BigEndian.Uint32(data) != 9994 {
+		return nil, fmt.Errorf("%v is not a shapefile", path)
+	}
+	var res []Ring
+	for pos := 100; pos+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[pos+4:])) * 2 // 16 bit words
+		rec := data[pos+8 : min(pos+8+size, len(data))]
+		pos += 8 + size
+		if len(rec) < 44 {
+			continue
+		}
+		switch binary.LittleEndian.Uint32(rec) {
+		case 3, 5, 13, 15, 23, 25: // polyline and polygon, plain, Z and M
+		default:
+			continue
+		}
+		nparts := int(binary.LittleEndian.Uint32(rec[36:]))
+		npoints := int(binary.LittleEndian.Uint32(rec[40:]))
+		pts := 44 + 4*nparts
+		if nparts < 0 || npoints < 0 || pts+16*npoints > len(rec) {
+			return nil, fmt.Errorf("%v is corrupt", path)
+		}
+		for p := 0; p < nparts; p++ {
+			first := int(binary.LittleEndian.Uint32(rec[44+4*p:]))
+			last := npoints
+			if p < nparts-1 {
+				last = int(binary.LittleEndian.Uint32(rec[44+4*p+4:]))
+			}
+			if first < 0 || last > npoints || first > last {
+				return nil, fmt.Errorf("%v is corrupt", path)
+			}
+			var ring Ring
+			for i := first; i < last; i++ {
+				x := math.Float64frombits(binary.LittleEndian.Uint64(rec[pts+16*i:]))
+				y := math.Float64frombits(binary.LittleEndian.Uint64(rec[pts+16*i+8:]))
+				ring = append(ring, [2]float64{x, y})
+			}
+			res = append(res, ring)
+		}
+	}
+	return res, nil
+}
+
+// insideRings reports whether a point lies within the rings, by the even-odd
+// rule so that holes are excluded
+func insideRings(lat, lon float64, rings []Ring) bool {
+
+	inside := false
+	for _, r := range rings {
+		for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+			xi, yi := r[i][0], r[i][1]
+			xj, yj := r[j][0], r[j][1]
+			if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
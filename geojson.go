@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// GeoJSONParams configures the GeoJSON file for web maps and GIS
+type GeoJSONParams struct {
+	OutputGeoJSON string `yaml:"outputFile"`
+	ComboGeometry string `yaml:"comboGeometry"` // LineString or MultiPoint
+}
+
+const geo_linestring = "LineString"
+const geo_multipoint = "MultiPoint"
+
+type GeoFeatureCollection struct {
+	Type     string        `json:"type"`
+	Name     string        `json:"name,omitempty"`
+	Features []*GeoFeature `json:"features"`
+}
+
+type GeoFeature struct {
+	Type       string      `json:"type"`
+	Geometry   GeoGeometry `json:"geometry"`
+	Properties any         `json:"properties"`
+}
+
+type GeoGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+// GeoBonus holds the properties of a bonus feature, only those which may be
+// published. Question and Answer are deliberately left out.
+type GeoBonus struct {
+	BonusID     string
+	Name        string
+	Points      string
+	PointsValue int
+	Flags       string
+	Notes       string
+	Waffle      string
+	Image       string // filename, unescaped
+	Coords      string // as entered
+	Categories  []Category
+	StreamID    string
+}
+
+// GeoCombo holds the properties of a combo feature
+type GeoCombo struct {
+	ComboID      string
+	BriefDesc    string
+	ScoreMethod  int
+	MinimumTicks int
+	ScorePoints  string
+	BonusList    string
+	Categories   []Category
+	Compulsory   bool
+	StreamID     string
+}
+
+// geoPosition returns a GeoJSON position, longitude first
+func geoPosition(lat, lon float64) []float64 {
+
+	return []float64{lon, lat}
+}
+
+// geoBonus returns the feature for a bonus with valid coordinates
+func geoBonus(B *Bonus) *GeoFeature {
+
+	image, err := url.QueryUnescape(B.Image)
+	if err != nil {
+		image = B.Image
+	}
+	props := GeoBonus{BonusID: B.BonusID, Name: B.BriefDesc, Points: B.Points, PointsValue: B.PointsValue, Flags: B.Flags,
+		Notes: B.Notes, Waffle: B.Waffle, Image: image, Coords: B.OriginalCoords, Categories: B.Categories, StreamID: B.StreamID}
+	return &GeoFeature{Type: "Feature", Geometry: GeoGeometry{Type: "Point", Coordinates: geoPosition(B.Lat, B.Lon)}, Properties: props}
+}
+
+// geoCombo returns the feature for a combo, a line or set of points through
+// those of its members having valid coordinates
+func geoCombo(C *Combo) *GeoFeature {
+
+	var coords [][]float64
+	for _, cb := range C.Bonuses {
+		if B := BonusTable[cb.BonusID]; B.ValidCoords {
+			coords = append(coords, geoPosition(B.Lat, B.Lon))
+		}
+	}
+	geometry := CFG.GeoJSON.ComboGeometry
+	if len(coords) < 2 {
+		geometry = geo_multipoint // a line needs two positions
+	}
+	if len(coords) == 0 {
+		return nil
+	}
+	props := GeoCombo{ComboID: C.ComboID, BriefDesc: C.BriefDesc, ScoreMethod: C.ScoreMethod, MinimumTicks: C.MinimumTicks,
+		ScorePoints: C.ScorePoints, BonusList: C.BonusList, Categories: C.Categories, Compulsory: C.Compulsory, StreamID: C.StreamID}
+	return &GeoFeature{Type: "Feature", Geometry: GeoGeometry{Type: geometry, Coordinates: coords}, Properties: props}
+}
+
+// emitGeoJSON writes a FeatureCollection holding a Point for each bonus,
+// with its public fields as properties, and a feature for each combo of the
+// gpxStreams
+func emitGeoJSON(path string) {
+
+	fmt.Printf("Generating GeoJSON %v\n", path)
+	switch strings.ToLower(CFG.GeoJSON.ComboGeometry) {
+	case "", strings.ToLower(geo_linestring):
+		CFG.GeoJSON.ComboGeometry = geo_linestring
+	case strings.ToLower(geo_multipoint):
+		CFG.GeoJSON.ComboGeometry = geo_multipoint
+	default:
+		fmt.Printf("comboGeometry must be LineString or MultiPoint, not %v\n", CFG.GeoJSON.ComboGeometry)
+		return
+	}
+
+	fc := GeoFeatureCollection{Type: "FeatureCollection", Name: CFG.Title, Features: []*GeoFeature{}}
+	for _, sx := range gpxStreams() {
+		v := CFG.Streams[sx]
+		if v.Type == type_combo {
+			NCombo := 0
+			for _, C := range fetchCombos(sx) {
+				if f := geoCombo(C); f != nil {
+					fc.Features = append(fc.Features, f)
+					NCombo++
+				}
+			}
+			fmt.Printf("%v combos included in GeoJSON [%v]\n", NCombo, v.StreamID)
+			continue
+		}
+		NGeo := 0
+		for _, B := range fetchBonuses(sx) {
+			if !B.ValidCoords {
+				continue
+			}
+			fc.Features = append(fc.Features, geoBonus(B))
+			NGeo++
+		}
+		fmt.Printf("%v bonuses included in GeoJSON [%v]\n", NGeo, v.StreamID)
+	}
+
+	res, err := json.MarshalIndent(fc, "", " ")
+	checkerr(err)
+	checkerr(os.WriteFile(path, res, 0644))
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"text/template"
 )
 
 type GPXParams struct {
@@ -10,8 +15,30 @@ type GPXParams struct {
 	SymbolGPX   string `yaml:"symbol"`
 	LinkGPX     string `yaml:"link2map"`
 	CodeOnlyGPX bool   `yaml:"bonusidOnly"`
+
+	NameTemplate string       `yaml:"nameTemplate"` // replaces bonusidOnly
+	Symbols      []SymbolRule `yaml:"symbols"`      // first match wins, else symbol
+
+	// Garmin extensions
+	Garmin       bool    `yaml:"garmin"`
+	DisplayMode  string  `yaml:"displayMode"`  // SymbolOnly, SymbolAndName or SymbolAndDescription
+	Proximity    float64 `yaml:"proximity"`    // alert distance in metres
+	CategoryAxes []int   `yaml:"categoryAxes"` // default all
+}
+
+// SymbolRule chooses the symbol of bonuses having all of the given flags,
+// points within the given band and the given category
+type SymbolRule struct {
+	Flags     string `yaml:"flags"` // eg DN
+	MinPoints int    `yaml:"minPoints"`
+	MaxPoints int    `yaml:"maxPoints"` // 0 = no limit
+	Category  string `yaml:"category"`  // category description, any axis
+	Symbol    string `yaml:"symbol"`
 }
 
+// gpxNameTPL is the parsed nameTemplate, if any
+var gpxNameTPL *template.Template
+
 const gpxheader = `<?xml version="1.0" encoding="utf-8"?>
 <gpx creator="Bob Stammers (` + apptitle + `)" version="1.1"
 xsi:schemaLocation="http://www.topografix.com/GPX/1/1 
@@ -20,6 +47,21 @@ xmlns="http://www.topografix.com/GPX/1/1"
 xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
 `
 
+const gpxxNamespace = "http://www.garmin.com/xmlschemas/GpxExtensions/v3"
+
+// gpxHeader returns the opening of the GPX file, declaring Garmin's
+// namespace if its extensions are used
+func gpxHeader() string {
+
+	if !CFG.GPX.Garmin {
+		return gpxheader
+	}
+	res := strings.Replace(gpxheader, "http://www.topografix.com/GPX/1/1/gpx.xsd",
+		"http://www.topografix.com/GPX/1/1/gpx.xsd "+gpxxNamespace+" http://www8.garmin.com/xmlschemas/GpxExtensionsv3.xsd", 1)
+	return strings.Replace(res, `xmlns="http://www.topografix.com/GPX/1/1"`,
+		`xmlns="http://www.topografix.com/GPX/1/1" xmlns:gpxx="`+gpxxNamespace+`"`, 1)
+}
+
 func xmlsafe(s string) string {
 
 	x := map[string]string{`&`: `&amp;`, `"`: `&quot;`, `<`: `&lt;`, `>`: `&gt;`, `'`: `&#39;`}
@@ -30,32 +72,354 @@ func xmlsafe(s string) string {
 	return res
 }
 
-func writeWaypoint(lat, lon float64, bonusid, briefdesc string, pointsval int) {
+// matches reports whether B satisfies all the conditions of the rule
+func (r SymbolRule) matches(B *Bonus) bool {
+
+	for _, f := range r.Flags {
+		if !strings.ContainsRune(B.Flags, f) {
+			return false
+		}
+	}
+	if B.PointsValue < r.MinPoints || (r.MaxPoints != 0 && B.PointsValue > r.MaxPoints) {
+		return false
+	}
+	if r.Category != "" {
+		return slices.ContainsFunc(B.Categories, func(c Category) bool {
+			return strings.EqualFold(c.BriefDesc, r.Category)
+		})
+	}
+	return true
+}
+
+// waypointSymbol returns the symbol for a bonus, if any
+func waypointSymbol(B *Bonus) string {
+
+	for _, r := range CFG.GPX.Symbols {
+		if r.matches(B) {
+			return r.Symbol
+		}
+	}
+	return CFG.GPX.SymbolGPX
+}
+
+// waypointName returns the name given to a bonus in the GPX file
+func waypointName(B *Bonus) string {
+
+	return xmlsafe(bonusName(B))
+}
+
+// garminDisplayModes are the values of DisplayMode allowed by Garmin
+var garminDisplayModes = []string{"SymbolOnly", "SymbolAndName", "SymbolAndDescription"}
+
+// setupGPX checks the displayMode, correcting its capitalisation, and that
+// streams split by gpxSplitBy have a gpxFile to be split
+func setupGPX() {
+
+	for _, v := range CFG.Streams {
+		if v.GPXSplitBy != "" && v.GPXFile == "" {
+			fmt.Printf("Stream %v has gpxSplitBy but no gpxFile to split\n", v.StreamID)
+			os.Exit(1)
+		}
+	}
+	if CFG.GPX.DisplayMode == "" {
+		return
+	}
+	for _, m := range garminDisplayModes {
+		if strings.EqualFold(CFG.GPX.DisplayMode, m) {
+			CFG.GPX.DisplayMode = m
+			return
+		}
+	}
+	fmt.Printf("Unknown GPX displayMode %v, use one of %v\n", CFG.GPX.DisplayMode, strings.Join(garminDisplayModes, ", "))
+	os.Exit(1)
+}
+
+// parseNameTemplate parses nameTemplate, if any, before anything is written
+func parseNameTemplate() {
+
+	if CFG.GPX.NameTemplate == "" {
+		return
+	}
+	t, err := template.New("nameTemplate").Parse(CFG.GPX.NameTemplate)
+	if err != nil {
+		fmt.Printf("Parsing error in GPX nameTemplate\n%v\n", err)
+		os.Exit(1)
+	}
+	gpxNameTPL = t
+}
+
+// bonusName returns the name given to a bonus by every sat-nav format, made
+// from nameTemplate if there is one
+func bonusName(B *Bonus) string {
+
+	if gpxNameTPL != nil {
+		var name strings.Builder
+		err := gpxNameTPL.Execute(&name, B)
+		if err != nil {
+			fmt.Printf("nameTemplate %v\n", err)
+		}
+		return strings.TrimSpace(name.String())
+	}
+	if CFG.GPX.CodeOnlyGPX {
+		return B.BonusID
+	}
+	return B.BonusID + "-" + B.BriefDesc
+}
+
+// GPXWriter is a GPX file being written. Routes are held back until the
+// file is closed because GPX requires all waypoints to come first.
+type GPXWriter struct {
+	Path      string
+	F         *os.File
+	Waypoints int
+	Routes    int
+	rte       strings.Builder
+}
+
+// GPXFiles lists every GPX file opened, in order
+var GPXFiles []*GPXWriter
+
+// openGPX returns the writer for path, creating the file if it isn't
+// already open
+func openGPX(path string) *GPXWriter {
 
-	wpt := fmt.Sprintf("<wpt lat=\"%v\" lon=\"%v\"><name>%v", lat, lon, xmlsafe(bonusid))
-	if !CFG.GPX.CodeOnlyGPX {
-		wpt += fmt.Sprintf("-%v", xmlsafe(briefdesc))
+	for _, gw := range GPXFiles {
+		if gw.Path == path {
+			return gw
+		}
 	}
-	wpt += "</name>"
-	GPXF.WriteString(wpt)
+	fmt.Printf("Generating GPX %v\n", path)
+	F, err := os.Create(path)
+	checkerr(err)
+	gw := &GPXWriter{Path: path, F: F}
+	gw.F.WriteString(gpxHeader())
+	GPXFiles = append(GPXFiles, gw)
+	return gw
+}
+
+// closeGPXFiles completes every GPX file, reporting what each holds
+func closeGPXFiles() {
+
+	for _, gw := range GPXFiles {
+		gw.F.WriteString(gw.rte.String())
+		gw.F.WriteString("</gpx>\n")
+		gw.F.Close()
+		fmt.Printf("%v waypoints, %v routes in %v\n", gw.Waypoints, gw.Routes, gw.Path)
+	}
+	GPXFiles = nil
+}
+
+func writeWaypoint(gw *GPXWriter, B *Bonus) {
+
+	var wpt strings.Builder
+	wpt.WriteString(fmt.Sprintf("<wpt lat=\"%v\" lon=\"%v\"><name>%v", B.Lat, B.Lon, waypointName(B)))
+	wpt.WriteString("</name>")
 	if CFG.Title != "" {
-		GPXF.WriteString(fmt.Sprintf("<cmt>%v</cmt>", xmlsafe(CFG.Title)))
+		wpt.WriteString(fmt.Sprintf("<cmt>%v</cmt>", xmlsafe(CFG.Title)))
 	}
 	if CFG.GPX.LinkGPX != "" {
-		GPXF.WriteString(fmt.Sprintf(`<link href="%v%v,%v" />`, CFG.GPX.LinkGPX, lat, lon))
+		wpt.WriteString(fmt.Sprintf(`<link href="%v%v,%v" />`, CFG.GPX.LinkGPX, B.Lat, B.Lon))
+	}
+	wpt.WriteString(fmt.Sprintf("<desc>%v</desc>", B.PointsValue))
+	if sym := waypointSymbol(B); sym != "" {
+		wpt.WriteString(fmt.Sprintf("<sym>%v</sym>", xmlsafe(sym)))
+	}
+	if CFG.GPX.Garmin {
+		wpt.WriteString(waypointExtension(B))
+	}
+	wpt.WriteString("</wpt>\n")
+	gw.F.WriteString(wpt.String())
+	gw.Waypoints++
+
+}
+
+// waypointExtension returns Garmin's extensions to a waypoint, allowing
+// devices to sound a proximity alert and to filter by category
+func waypointExtension(B *Bonus) string {
+
+	var res strings.Builder
+	res.WriteString("<extensions><gpxx:WaypointExtension>")
+	if CFG.GPX.Proximity > 0 {
+		res.WriteString(fmt.Sprintf("<gpxx:Proximity>%v</gpxx:Proximity>", CFG.GPX.Proximity))
+	}
+	if CFG.GPX.DisplayMode != "" {
+		res.WriteString(fmt.Sprintf("<gpxx:DisplayMode>%v</gpxx:DisplayMode>", xmlsafe(CFG.GPX.DisplayMode)))
+	}
+	var cats []string
+	for _, c := range B.Categories {
+		if len(CFG.GPX.CategoryAxes) > 0 && !slices.Contains(CFG.GPX.CategoryAxes, c.Axis) {
+			continue
+		}
+		cats = append(cats, "<gpxx:Category>"+xmlsafe(c.BriefDesc)+"</gpxx:Category>")
+	}
+	if len(cats) > 0 {
+		res.WriteString("<gpxx:Categories>" + strings.Join(cats, "") + "</gpxx:Categories>")
+	}
+	res.WriteString("</gpxx:WaypointExtension></extensions>")
+	return res.String()
+}
+
+// writeRoute adds a route through pts to gw
+func writeRoute(gw *GPXWriter, name, desc string, pts []*Bonus) {
+
+	rte := &gw.rte
+	rte.WriteString(fmt.Sprintf("<rte><name>%v</name>", xmlsafe(name)))
+	if desc != "" {
+		rte.WriteString(fmt.Sprintf("<desc>%v</desc>", xmlsafe(desc)))
 	}
-	GPXF.WriteString(fmt.Sprintf("<desc>%v</desc>", pointsval))
-	if CFG.GPX.SymbolGPX != "" {
-		GPXF.WriteString(fmt.Sprintf("<sym>%v</sym>", CFG.GPX.SymbolGPX))
+	rte.WriteString("\n")
+	for _, B := range pts {
+		rte.WriteString(fmt.Sprintf("<rtept lat=\"%v\" lon=\"%v\"><name>%v</name>", B.Lat, B.Lon, waypointName(B)))
+		if sym := waypointSymbol(B); sym != "" {
+			rte.WriteString(fmt.Sprintf("<sym>%v</sym>", xmlsafe(sym)))
+		}
+		rte.WriteString("</rtept>\n")
 	}
-	GPXF.WriteString("</wpt>\n")
+	rte.WriteString("</rte>\n")
+	gw.Routes++
+}
+
+var fileCharsRE = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// streamGPXPath returns the path of the file for the stream's bonuses having
+// the given value of gpxSplitBy. A '*' in gpxFile is replaced by the value,
+// otherwise it's added before the extension.
+func streamGPXPath(bs BonusStream, value string) string {
 
+	path := bs.GPXFile
+	if bs.GPXSplitBy != "" {
+		value = strings.Trim(fileCharsRE.ReplaceAllString(value, "_"), "_")
+		if value == "" {
+			value = "none"
+		}
+		if strings.Contains(path, "*") {
+			path = strings.ReplaceAll(path, "*", value)
+		} else {
+			ext := filepath.Ext(path)
+			path = strings.TrimSuffix(path, ext) + "-" + value + ext
+		}
+	}
+	return outputPath(path)
 }
 
-func completeGPX() {
+// gpxStreams returns the index of each stream listed in sections which
+// includes 'emitGPX: true', in section order. These streams make up the GPX
+// and also the KML, GeoJSON and point of interest files.
+func gpxStreams() []int {
 
-	GPXF.WriteString("</gpx>\n")
+	var res []int
+	for _, section := range CFG.Sections {
+		sf := strings.Split(section, ".")
+		if len(sf) < 2 || sf[0] != stream_prefix {
+			continue
+		}
+		for sx, v := range CFG.Streams {
+			if v.StreamID == sf[1] && v.EmitGPX && v.Type != type_entrant {
+				res = append(res, sx)
+			}
+		}
+	}
+	return res
+}
+
+// emitGPXStreams writes a waypoint for each bonus of the gpxStreams. Bonus
+// streams with 'gpxRoute: true' are also written as a route, in stream
+// order, and each combo of a combo stream as a route through its member
+// bonuses. Streams with a gpxFile are written to that file, or files, rather
+// than the main GPX.
+func emitGPXStreams(main *GPXWriter) {
+
+	for _, sx := range gpxStreams() {
+		v := CFG.Streams[sx]
+		if v.GPXFile == "" && main == nil {
+			continue
+		}
+		if v.Type == type_combo {
+			gw := main
+			if v.GPXFile != "" {
+				gw = openGPX(streamGPXPath(v, ""))
+			}
+			emitGPXCombos(gw, sx)
+			continue
+		}
+		NGpx := 0
+		var files []*GPXWriter
+		pts := make(map[*GPXWriter][]*Bonus)
+		for _, B := range fetchBonuses(sx) {
+			if !B.ValidCoords {
+				fmt.Printf("%v Coords err:%v\n", B.BonusID, B.coordsErr)
+				continue
+			}
+			gw := main
+			if v.GPXFile != "" {
+				gw = openGPX(streamGPXPath(v, groupKey(B, v.GPXSplitBy)))
+			}
+			if _, ok := pts[gw]; !ok {
+				files = append(files, gw)
+			}
+			writeWaypoint(gw, B)
+			pts[gw] = append(pts[gw], B)
+			NGpx++
+		}
+		fmt.Printf("%v bonuses included in GPX [%v]\n", NGpx, v.StreamID)
+		if !v.GPXRoute {
+			continue
+		}
+		name := v.RouteName
+		if name == "" {
+			name = v.Title
+		}
+		if name == "" {
+			name = v.StreamID
+		}
+		for _, gw := range files {
+			writeRoute(gw, name, v.RouteDesc, pts[gw])
+			fmt.Printf("Route of %v bonuses included in GPX [%v]\n", len(pts[gw]), v.StreamID)
+		}
+	}
+}
 
+// emitGPXCombos adds a route for each combo of stream s, named after the
+// combo, visiting its member bonuses in the order listed
+func emitGPXCombos(gw *GPXWriter, s int) {
+
+	NRte := 0
+	for _, C := range fetchCombos(s) {
+		var pts []*Bonus
+		for _, cb := range C.Bonuses {
+			B := BonusTable[cb.BonusID]
+			if !B.ValidCoords {
+				fmt.Printf("%v Coords err in combo %v\n", B.BonusID, C.ComboID)
+				continue
+			}
+			pts = append(pts, B)
+		}
+		if len(pts) == 0 {
+			continue
+		}
+		writeRoute(gw, comboRouteName(C), comboRouteDesc(C, s), pts)
+		NRte++
+	}
+	fmt.Printf("%v combo routes included in GPX [%v]\n", NRte, CFG.Streams[s].StreamID)
+}
+
+// comboRouteName returns the name of the route through a combo's bonuses
+func comboRouteName(C *Combo) string {
+
+	if CFG.GPX.CodeOnlyGPX {
+		return C.ComboID
+	}
+	return C.ComboID + "-" + C.BriefDesc
+}
+
+// comboRouteDesc returns the description of the route through a combo's
+// bonuses, shared by every combo of stream s if the stream gives one
+func comboRouteDesc(C *Combo, s int) string {
+
+	if CFG.Streams[s].RouteDesc != "" {
+		return CFG.Streams[s].RouteDesc
+	}
+	return C.BriefDesc
 }
 
 func cleanCoords(coords string) string {
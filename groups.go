@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// BonusGroup is passed to a stream's groupHeader template
+type BonusGroup struct {
+	StreamID    string
+	GroupBy     string
+	Name        string
+	Count       int
+	PointsTotal int
+	PageNumber  int
+	Bonuses     []*Bonus
+}
+
+// groupKey returns the value of the named field of B. Cat1 - Cat9 give the
+// category description rather than its number.
+func groupKey(B *Bonus, field string) string {
+
+	if len(field) == 4 && strings.HasPrefix(field, "Cat") {
+		axis, err := strconv.Atoi(field[3:])
+		if err == nil && axis > 0 && axis <= numCatAxes {
+			return B.CatName(axis)
+		}
+	}
+	v := reflect.ValueOf(B).Elem().FieldByName(field)
+	if !v.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// groupBonuses splits the bonuses into groups sharing the same value of
+// field. Groups appear in the order of their first member so the stream's
+// orderByField decides the order of groups as well as bonuses. With no field
+// every bonus belongs to a single group.
+func groupBonuses(bonuses []*Bonus, field string) []*BonusGroup {
+
+	var res []*BonusGroup
+	groups := make(map[string]*BonusGroup)
+	for _, B := range bonuses {
+		key := ""
+		if field != "" {
+			key = groupKey(B, field)
+		}
+		G, ok := groups[key]
+		if !ok {
+			G = &BonusGroup{StreamID: B.StreamID, GroupBy: field, Name: key}
+			groups[key] = G
+			res = append(res, G)
+		}
+		G.Bonuses = append(G.Bonuses, B)
+		G.Count++
+		G.PointsTotal += B.PointsValue
+	}
+	return res
+}
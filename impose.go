@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Booklet imposition places the pages of the book two to a sheet, in the
+// order needed for the sheets to be printed duplex, folded down the middle
+// and stapled. Each page becomes a 'leaf' of fixed size. Any content before
+// the first page, usually the front cover, forms a leaf of its own and blank
+// leaves are added to make a multiple of four.
+
+const impose_booklet = "booklet"
+
+const css_booklet = `
+/* booklet imposition */
+@page {
+  size: %[1]vmm %[2]vmm;
+  margin: 0;
+}
+
+@media print {
+  @page {
+    size: %[1]vmm %[2]vmm;
+    margin: 0;
+  }
+}
+
+body {
+  width: %[1]vmm;
+  margin: 0;
+}
+
+.sheet {
+  display: flex;
+  flex-direction: row;
+  width: %[1]vmm;
+  height: %[2]vmm;
+  overflow: hidden;
+  page-break-after: always;
+}
+
+.leaf {
+  width: %[3]vmm;
+  height: %[2]vmm;
+  overflow: hidden;
+}
+
+/* each page fills its leaf, keeping the running footer in view, and the
+   sheets alone break the printed pages */
+.leaf .page {
+  height: 100%%;
+}
+
+.leaf .page,
+.leaf .newpage,
+.leaf #frontpage {
+  page-break-after: auto;
+}
+`
+
+var divTokenRE = regexp.MustCompile(`(?is)<!--.*?-->|<div\b[^>]*>|</div\s*>`)
+
+// sheetDimensions returns the width and height, in mm, of the paper
+// actually fed to the printer
+func sheetDimensions() (float64, float64) {
+
+	w, h := pageDimensions()
+	if CFG.Paper.Impose == impose_booklet {
+		return w * 2, h
+	}
+	return w, h
+}
+
+// splitLeaves divides the body of the book into leaves at the start of each
+// page. Divs left open at a split are closed at the end of the leaf and
+// reopened at the start of the next so that each leaf stands alone.
+func splitLeaves(body []byte) []string {
+
+	starts := []int{0}
+	for _, loc := range pageTags(body) {
+		if loc[0] > 0 {
+			starts = append(starts, loc[0])
+		}
+	}
+	starts = append(starts, len(body))
+
+	var leaves []string
+	var open []string // opening tags of divs not yet closed
+	for i := 0; i < len(starts)-1; i++ {
+		seg := body[starts[i]:starts[i+1]]
+		var leaf strings.Builder
+		leaf.WriteString(strings.Join(open, ""))
+		for _, loc := range divTokenRE.FindAllIndex(seg, -1) {
+			tok := string(seg[loc[0]:loc[1]])
+			switch {
+			case strings.HasPrefix(tok, "<!--"):
+			case strings.HasPrefix(tok, "</"):
+				if len(open) > 0 {
+					open = open[:len(open)-1]
+				}
+			default:
+				open = append(open, tok)
+			}
+		}
+		leaf.Write(seg)
+		leaf.WriteString(strings.Repeat("</div>", len(open)))
+		if i == 0 && strings.TrimSpace(htmlTagRE.ReplaceAllString(leaf.String(), "")) == "" &&
+			!strings.Contains(leaf.String(), "<img") {
+			continue // nothing before the first page
+		}
+		leaves = append(leaves, leaf.String())
+	}
+	return leaves
+}
+
+// bookletOrder returns the leaf numbers, from 0, of the left and right of
+// each side of each sheet, front then back. n must be a multiple of 4.
+func bookletOrder(n int) []int {
+
+	var res []int
+	for s := 0; s < n/4; s++ {
+		res = append(res, n-1-2*s, 2*s)   // front
+		res = append(res, 2*s+1, n-2-2*s) // back
+	}
+	return res
+}
+
+// imposeBooklet rearranges the finished HTML book into booklet sheets
+func imposeBooklet(html []byte) []byte {
+
+	bodyStart := bytes.Index(html, []byte(htmlhead2))
+	bodyEnd := bytes.LastIndex(html, []byte(htmlfoot))
+	if bodyStart < 0 || bodyEnd < bodyStart {
+		fmt.Println("Can't impose booklet, document structure not recognised")
+		return html
+	}
+	bodyStart += len(htmlhead2)
+
+	leaves := splitLeaves(html[bodyStart:bodyEnd])
+	for len(leaves)%4 != 0 {
+		leaves = append(leaves, "")
+	}
+	fmt.Printf("Booklet of %v sheets\n", len(leaves)/4)
+
+	pw, _ := pageDimensions()
+	sw, sh := sheetDimensions()
+	var res bytes.Buffer
+	res.Write(html[:bodyStart-len(htmlhead2)])
+	res.WriteString(fmt.Sprintf(css_booklet, sw, sh, pw))
+	res.WriteString(htmlhead2)
+	order := bookletOrder(len(leaves))
+	for i := 0; i < len(order); i += 2 {
+		res.WriteString("\n<div class=\"sheet\">\n<div class=\"leaf\">")
+		res.WriteString(leaves[order[i]])
+		res.WriteString("</div>\n<div class=\"leaf\">")
+		res.WriteString(leaves[order[i+1]])
+		res.WriteString("</div>\n</div><!-- sheet -->\n")
+	}
+	res.Write(html[bodyEnd:])
+	return res.Bytes()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KMLParams configures the KML file for Google Earth and My Maps. A .kmz
+// file is zipped, with the bonus images, so that balloons show them wherever
+// the file is opened.
+type KMLParams struct {
+	OutputKML string `yaml:"outputFile"` // .kml or .kmz
+	Balloon   string `yaml:"balloon"`    // template for placemark balloons
+}
+
+// KMLPlacemark is passed to the balloon template for each bonus
+type KMLPlacemark struct {
+	*Bonus
+	ImageSrc string // link to the bonus image, if any
+}
+
+const kmlBalloon = "kmlballoon"
+
+const kmlBalloonTemplate = `<h3>{{.BonusID}} {{.BriefDesc}}</h3>
+<p><strong>{{.Points}} points</strong>{{if .Flags}} &nbsp; Flags: {{.Flags}}{{end}}</p>
+{{if .ImageSrc}}<img src="{{.ImageSrc}}" alt="{{.BonusID}}" width="300">{{end}}
+{{if .Notes}}<p><strong>{{.Notes}}</strong></p>{{end}}
+{{if .Waffle}}<p>{{.Waffle}}</p>{{end}}
+`
+
+const kmlheader = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2">
+<Document>
+`
+
+const kmlfoot = `</Document>
+</kml>
+`
+
+// KMLFile accumulates the KML and, for a KMZ, the images to be included
+type KMLFile struct {
+	buf    bytes.Buffer
+	kmz    bool
+	images map[string]string // name in the KMZ : path on disk
+	names  []string
+}
+
+// cdata wraps s so that it's passed through by the XML parser untouched
+func cdata(s string) string {
+
+	return "<![CDATA[" + strings.ReplaceAll(s, "]]>", "]]]]><![CDATA[>") + "]]>"
+}
+
+// imageSrc returns the link to the bonus image, adding it to a KMZ
+func (kf *KMLFile) imageSrc(B *Bonus) string {
+
+	if B.Image == "" {
+		return ""
+	}
+	if !kf.kmz {
+		return B.ImageFolder + "/bonuses/" + B.Image
+	}
+	name, err := url.QueryUnescape(B.Image)
+	if err != nil {
+		name = B.Image
+	}
+	src := "images/" + name
+	if _, ok := kf.images[src]; ok {
+		return src
+	}
+	path := filepath.Join(CFG.OutputFolder, CFG.ImageFolder, "bonuses", name)
+	if !fileExists(path) {
+		fmt.Printf("%v image %v not found\n", B.BonusID, path)
+		return ""
+	}
+	kf.images[src] = path
+	kf.names = append(kf.names, src)
+	return src
+}
+
+// placemark adds a bonus to the KML
+func (kf *KMLFile) placemark(B *Bonus) {
+
+	var balloon bytes.Buffer
+	t := builtinTemplate(CFG.KML.Balloon, kmlBalloonTemplate)
+	err := t.Execute(&balloon, KMLPlacemark{Bonus: B, ImageSrc: kf.imageSrc(B)})
+	if err != nil {
+		fmt.Printf("balloon %v\n", err)
+	}
+	kf.buf.WriteString(fmt.Sprintf("<Placemark><name>%v</name><description>%v</description>", waypointName(B), cdata(balloon.String())))
+	kf.buf.WriteString(fmt.Sprintf("<Point><coordinates>%v,%v,0</coordinates></Point></Placemark>\n", B.Lon, B.Lat))
+}
+
+// line adds a path through pts to the KML, the counterpart of a GPX route
+func (kf *KMLFile) line(name, desc string, pts []*Bonus) {
+
+	kf.buf.WriteString(fmt.Sprintf("<Placemark><name>%v</name>", xmlsafe(name)))
+	if desc != "" {
+		kf.buf.WriteString(fmt.Sprintf("<description>%v</description>", xmlsafe(desc)))
+	}
+	kf.buf.WriteString("<LineString><tessellate>1</tessellate><coordinates>")
+	for _, B := range pts {
+		kf.buf.WriteString(fmt.Sprintf("%v,%v,0 ", B.Lon, B.Lat))
+	}
+	kf.buf.WriteString("</coordinates></LineString></Placemark>\n")
+}
+
+// emitKML writes a folder of placemarks for each of the gpxStreams, with
+// lines for any routes and combos
+func emitKML(path string) {
+
+	fmt.Printf("Generating KML %v\n", path)
+	kf := &KMLFile{kmz: strings.EqualFold(filepath.Ext(path), ".kmz"), images: make(map[string]string)}
+	if CFG.KML.Balloon == "" {
+		CFG.KML.Balloon = kmlBalloon
+	}
+	kf.buf.WriteString(kmlheader)
+	kf.buf.WriteString(fmt.Sprintf("<name>%v</name>\n", xmlsafe(CFG.Title)))
+	if CFG.Description != "" {
+		kf.buf.WriteString(fmt.Sprintf("<description>%v</description>\n", xmlsafe(CFG.Description)))
+	}
+	for _, sx := range gpxStreams() {
+		v := CFG.Streams[sx]
+		name := v.Title
+		if name == "" {
+			name = v.StreamID
+		}
+		kf.buf.WriteString(fmt.Sprintf("<Folder><name>%v</name>\n", xmlsafe(name)))
+		if v.Type == type_combo {
+			for _, C := range fetchCombos(sx) {
+				var pts []*Bonus
+				for _, cb := range C.Bonuses {
+					if B := BonusTable[cb.BonusID]; B.ValidCoords {
+						pts = append(pts, B)
+					}
+				}
+				if len(pts) > 0 {
+					kf.line(comboRouteName(C), comboRouteDesc(C, sx), pts)
+				}
+			}
+			kf.buf.WriteString("</Folder>\n")
+			continue
+		}
+		NKml := 0
+		var pts []*Bonus
+		for _, B := range fetchBonuses(sx) {
+			if !B.ValidCoords {
+				continue
+			}
+			kf.placemark(B)
+			pts = append(pts, B)
+			NKml++
+		}
+		if v.GPXRoute && len(pts) > 0 {
+			if v.RouteName != "" {
+				name = v.RouteName
+			}
+			kf.line(name, v.RouteDesc, pts)
+		}
+		kf.buf.WriteString("</Folder>\n")
+		fmt.Printf("%v bonuses included in KML [%v]\n", NKml, v.StreamID)
+	}
+	kf.buf.WriteString(kmlfoot)
+
+	if !kf.kmz {
+		err := os.WriteFile(path, kf.buf.Bytes(), 0644)
+		checkerr(err)
+		return
+	}
+	F, err := os.Create(path)
+	checkerr(err)
+	defer F.Close()
+	zw := zip.NewWriter(F)
+	w, err := zw.Create("doc.kml")
+	checkerr(err)
+	w.Write(kf.buf.Bytes())
+	for _, src := range kf.names {
+		img, err := os.ReadFile(kf.images[src])
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			continue
+		}
+		w, err := zw.Create(src)
+		checkerr(err)
+		w.Write(img)
+	}
+	checkerr(zw.Close())
+	fmt.Printf("%v images included in KMZ\n", len(kf.names))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	_ "image/jpeg"
+)
+
+// LocatorParams configures the small maps, centred on each bonus, offered to
+// the templates of streams with 'locatorMaps: true'. They're drawn from the
+// map outline or, if given, raster tiles in a local MBTiles file.
+type LocatorParams struct {
+	Folder       string  `yaml:"folder"`       // within the output folder, default maps
+	Size         int     `yaml:"size"`         // pixels square, default 300
+	RadiusKm     float64 `yaml:"radiusKm"`     // area shown, outline maps, default 10
+	Outline      string  `yaml:"outline"`      // default map.outline
+	MBTiles      string  `yaml:"mbtiles"`      // in the project folder
+	Zoom         int     `yaml:"zoom"`         // MBTiles zoom level, default 12
+	NoNeighbours bool    `yaml:"noNeighbours"` // show only the bonus itself
+}
+
+const defaultLocatorFolder = "maps"
+const defaultLocatorSize = 300
+const defaultLocatorRadiusKm = 10
+const defaultLocatorZoom = 12
+const tileSize = 256
+
+var locatorTiles *sql.DB
+var locatorOutlines []Ring
+var locatorSetup bool
+
+// setupLocator fills in the defaults and opens the data, once
+func setupLocator() {
+
+	if locatorSetup {
+		return
+	}
+	locatorSetup = true
+	L := &CFG.Locator
+	if L.Folder == "" {
+		L.Folder = defaultLocatorFolder
+	}
+	if L.Size < 1 {
+		L.Size = defaultLocatorSize
+	}
+	if L.RadiusKm <= 0 {
+		L.RadiusKm = defaultLocatorRadiusKm
+	}
+	if L.Zoom < 1 {
+		L.Zoom = defaultLocatorZoom
+	}
+	checkerr(os.MkdirAll(filepath.Join(CFG.OutputFolder, L.Folder), 0755))
+	if BonusTable == nil {
+		loadBonusTable()
+	}
+	if L.MBTiles != "" {
+		path := projectPath(L.MBTiles)
+		if !fileExists(path) {
+			fmt.Printf("Can't find MBTiles %v\n", path)
+		} else {
+			db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+			checkerr(err)
+			locatorTiles = db
+		}
+		return
+	}
+	outline := L.Outline
+	if outline == "" {
+		outline = CFG.Map.Outline
+	}
+	if outline != "" {
+		rings, err := loadOutlines(projectPath(outline))
+		if err != nil {
+			fmt.Printf("Can't load locator map outline: %v\n", err)
+		}
+		locatorOutlines = rings
+	}
+}
+
+// projectPath returns the path of a file named in the config relative to the
+// project folder
+func projectPath(x string) string {
+
+	if filepath.IsAbs(x) {
+		return x
+	}
+	return filepath.Join(CFG.ProjectFolder, x)
+}
+
+// locatorDots returns the dots to be shown on the locator map of B, B itself
+// last so that it's drawn on top. Neighbours are shown only if xy places them
+// on the map.
+func locatorDots(B *Bonus, xy func(lat, lon float64) (float64, float64)) []mapDot {
+
+	var res []mapDot
+	size := float64(CFG.Locator.Size)
+	if !CFG.Locator.NoNeighbours {
+		var ids []string
+		for id, N := range BonusTable {
+			if N.ValidCoords && id != B.BonusID {
+				ids = append(ids, id)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool { return lessBonusID(ids[i], ids[j]) })
+		for _, id := range ids {
+			N := BonusTable[id]
+			if x, y := xy(N.Lat, N.Lon); x < 0 || y < 0 || x > size || y > size {
+				continue
+			}
+			res = append(res, mapDot{lat: N.Lat, lon: N.Lon, colour: "#555555", label: N.BonusID, radius: 3})
+		}
+	}
+	return append(res, mapDot{lat: B.Lat, lon: B.Lon, colour: "#d62728", label: B.BonusID, radius: 5})
+}
+
+// locatorMap returns the path, relative to the output folder, of the locator
+// map of B, drawing it unless an identical map was drawn by an earlier run
+func locatorMap(B *Bonus) string {
+
+	if !B.ValidCoords {
+		return ""
+	}
+	setupLocator()
+	L := CFG.Locator
+	dlat := L.RadiusKm * 1000 / (earthRadiusMetres * rad)
+	dlon := dlat / math.Cos(B.Lat*rad)
+	v := newMapView(B.Lat-dlat, B.Lon-dlon, B.Lat+dlat, B.Lon+dlon, float64(L.Size), 0)
+	xy := v.xy
+	if locatorTiles != nil {
+		cx, cy := tilePixel(B.Lat, B.Lon, L.Zoom)
+		xy = func(lat, lon float64) (float64, float64) {
+			x, y := tilePixel(lat, lon, L.Zoom)
+			return x - cx + float64(L.Size/2), y - cy + float64(L.Size/2)
+		}
+	}
+	dots := locatorDots(B, xy)
+
+	// The name includes a hash of everything drawn so a changed map gets a
+	// new file and an unchanged one is reused
+	h := sha1.New()
+	fmt.Fprintf(h, "%v %v %v %v %v %v\n", L.Size, L.RadiusKm, L.Zoom, L.MBTiles, len(locatorOutlines), dots)
+	for _, src := range []string{L.MBTiles, L.Outline, CFG.Map.Outline} {
+		if src == "" {
+			continue
+		}
+		if fi, err := os.Stat(projectPath(src)); err == nil {
+			fmt.Fprintf(h, "%v %v %v\n", src, fi.Size(), fi.ModTime())
+		}
+	}
+	ext := ".svg"
+	if locatorTiles != nil {
+		ext = ".png"
+	}
+	name := filepath.Join(L.Folder, fmt.Sprintf("%v-%x%v", anchorCharsRE.ReplaceAllString(B.BonusID, "_"), h.Sum(nil)[:4], ext))
+	path := filepath.Join(CFG.OutputFolder, name)
+	if fileExists(path) {
+		return filepath.ToSlash(name)
+	}
+
+	if locatorTiles != nil {
+		var buf bytes.Buffer
+		checkerr(png.Encode(&buf, tileMap(B, dots)))
+		checkerr(os.WriteFile(path, buf.Bytes(), 0644))
+		return filepath.ToSlash(name)
+	}
+	checkerr(os.WriteFile(path, []byte(svgMap(v, locatorOutlines, dots, true)), 0644))
+	return filepath.ToSlash(name)
+}
+
+// tilePixel returns the position of a point, in pixels, on the Web Mercator
+// map of the world at zoom z
+func tilePixel(lat, lon float64, z int) (float64, float64) {
+
+	n := float64(tileSize) * math.Exp2(float64(z))
+	phi := lat * rad
+	return (lon + 180) / 360 * n, (1 - math.Log(math.Tan(phi)+1/math.Cos(phi))/math.Pi) / 2 * n
+}
+
+// tileMap returns the map of B assembled from the MBTiles, with dots on top
+func tileMap(B *Bonus, dots []mapDot) *image.RGBA {
+
+	L := CFG.Locator
+	img := image.NewRGBA(image.Rect(0, 0, L.Size, L.Size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{244, 248, 251, 255}}, image.Point{}, draw.Src)
+	cx, cy := tilePixel(B.Lat, B.Lon, L.Zoom)
+	left, top := int(cx)-L.Size/2, int(cy)-L.Size/2
+	rows := 1 << L.Zoom
+	for ty := top / tileSize; ty <= (top+L.Size-1)/tileSize; ty++ {
+		for tx := left / tileSize; tx <= (left+L.Size-1)/tileSize; tx++ {
+			var data []byte
+			err := locatorTiles.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level=? AND tile_column=? AND tile_row=?",
+				L.Zoom, tx, rows-1-ty).Scan(&data) // MBTiles rows count from the south
+			if err != nil {
+				continue
+			}
+			tile, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				fmt.Printf("Tile %v/%v/%v: %v\n", L.Zoom, tx, ty, err)
+				continue
+			}
+			at := image.Pt(tx*tileSize-left, ty*tileSize-top)
+			draw.Draw(img, tile.Bounds().Add(at), tile, tile.Bounds().Min, draw.Over)
+		}
+	}
+	for _, dot := range dots {
+		x, y := tilePixel(dot.lat, dot.lon, L.Zoom)
+		drawDot(img, x-float64(left), y-float64(top), dot.radius, hexColour(dot.colour))
+	}
+	return img
+}
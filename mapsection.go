@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MapParams configures the overview maps drawn by 'rbook.map.streamid'
+// sections.
+// Everything is drawn from local data, no map tiles are fetched.
+type MapParams struct {
+	Title    string   `yaml:"title"`
+	Outline  string   `yaml:"outline"`  // GeoJSON or shapefile in the project folder
+	ColourBy string   `yaml:"colourBy"` // bonus field or Cat1 - Cat9
+	Colours  []string `yaml:"colours"`  // palette
+	NoLabels bool     `yaml:"noLabels"`
+	PNG      bool     `yaml:"png"` // also write a PNG, without labels
+}
+
+const mapWidth = 1000 // SVG units
+
+// defaultMapColours is the palette used unless the config gives one
+var defaultMapColours = []string{"#1f77b4", "#d62728", "#2ca02c", "#ff7f0e", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"}
+
+// MapLegend is one colour shown on the map
+type MapLegend struct {
+	Name   string
+	Colour template.CSS
+	Count  int
+}
+
+// MapPage is passed to the map template
+type MapPage struct {
+	Title    string
+	StreamID string
+	Count    int
+	SVG      template.HTML // the map, ready to include in the page
+	Image    string        // the SVG file, relative to the output folder
+	PNGImage string        // the PNG file, if wanted
+	Legend   []MapLegend
+}
+
+const mapTemplate = `
+<div class="page map">
+<h3>{{.Title}}</h3>
+{{.SVG}}
+{{if .Legend}}<p class="maplegend">{{range .Legend}}<span style="color:{{.Colour}}">&#9679;</span>&nbsp;{{.Name}} ({{.Count}}) &nbsp; {{end}}</p>{{end}}
+</div>
+`
+
+// mapPages holds each map once drawn, as the book may be laid out more than
+// once
+var mapPages = make(map[string]*MapPage)
+
+// mapOutlines holds the outlines once loaded
+var mapOutlines []Ring
+var mapOutlinesLoaded bool
+
+// mapDot is one bonus on a map
+type mapDot struct {
+	lat, lon float64
+	colour   string
+	label    string
+	radius   float64
+}
+
+// mapView projects latitude and longitude onto the map, equirectangular
+// with longitude scaled to be true at the middle latitude
+type mapView struct {
+	minLat, minLon, maxLat, maxLon float64
+	scale, cosLat                  float64
+	width, height                  float64
+}
+
+// newMapView returns a view of width units showing the area given, with a
+// margin, never less than minSpan degrees of latitude
+func newMapView(minLat, minLon, maxLat, maxLon float64, width float64, minSpan float64) mapView {
+
+	midLat, midLon := (minLat+maxLat)/2, (minLon+maxLon)/2
+	cosLat := math.Cos(midLat * rad)
+	latSpan := math.Max(maxLat-minLat, minSpan) * 1.1
+	lonSpan := math.Max(maxLon-minLon, minSpan/cosLat) * 1.1
+	v := mapView{minLat: midLat - latSpan/2, maxLat: midLat + latSpan/2, minLon: midLon - lonSpan/2, maxLon: midLon + lonSpan/2, cosLat: cosLat}
+	v.width = width
+	v.scale = width / (lonSpan * cosLat)
+	v.height = math.Round(latSpan * v.scale)
+	return v
+}
+
+func (v mapView) xy(lat, lon float64) (float64, float64) {
+
+	return (lon - v.minLon) * v.cosLat * v.scale, (v.maxLat - lat) * v.scale
+}
+
+// visible reports whether any part of r might be on the map
+func (v mapView) visible(r Ring) bool {
+
+	minLon, minLat, maxLon, maxLat := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, p := range r {
+		minLon, maxLon = math.Min(minLon, p[0]), math.Max(maxLon, p[0])
+		minLat, maxLat = math.Min(minLat, p[1]), math.Max(maxLat, p[1])
+	}
+	return maxLon >= v.minLon && minLon <= v.maxLon && maxLat >= v.minLat && minLat <= v.maxLat
+}
+
+// loadMapOutlines reads the configured outline file, once
+func loadMapOutlines() []Ring {
+
+	if mapOutlinesLoaded || CFG.Map.Outline == "" {
+		return mapOutlines
+	}
+	mapOutlinesLoaded = true
+	rings, err := loadOutlines(projectPath(CFG.Map.Outline))
+	if err != nil {
+		fmt.Printf("Can't load map outline: %v\n", err)
+	}
+	mapOutlines = rings
+	return mapOutlines
+}
+
+// svgMap returns the SVG drawing of the outlines and dots
+func svgMap(v mapView, outlines []Ring, dots []mapDot, labels bool) string {
+
+	var svg strings.Builder
+	svg.WriteString(fmt.Sprintf(`<svg class="bonusmap" xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %v %v" style="width:100%%;height:auto">`, v.width, v.height))
+	svg.WriteString(fmt.Sprintf(`<rect width="%v" height="%v" fill="#f4f8fb" stroke="#999"/>`, v.width, v.height))
+	svg.WriteString(`<g fill="none" stroke="#888" stroke-width="1">`)
+	for _, r := range outlines {
+		if len(r) < 2 || !v.visible(r) {
+			continue
+		}
+		var d strings.Builder
+		lx, ly := math.Inf(1), math.Inf(1)
+		for i, p := range r {
+			x, y := v.xy(p[1], p[0])
+			if i > 0 && i < len(r)-1 && math.Abs(x-lx) < 0.5 && math.Abs(y-ly) < 0.5 {
+				continue // too small to see
+			}
+			if i == 0 {
+				d.WriteString("M")
+			} else {
+				d.WriteString("L")
+			}
+			d.WriteString(fmt.Sprintf("%.1f %.1f", x, y))
+			lx, ly = x, y
+		}
+		svg.WriteString(`<path d="` + d.String() + `"/>`)
+	}
+	svg.WriteString("</g>\n")
+	for _, dot := range dots {
+		x, y := v.xy(dot.lat, dot.lon)
+		svg.WriteString(fmt.Sprintf(`<circle cx="%.1f" cy="%.1f" r="%v" fill="%v" stroke="#fff" stroke-width="0.5"/>`, x, y, dot.radius, xmlsafe(dot.colour)))
+		if labels && dot.label != "" {
+			svg.WriteString(fmt.Sprintf(`<text x="%.1f" y="%.1f" font-size="%v" font-family="sans-serif">%v</text>`,
+				x+dot.radius+1, y+dot.radius, 2.5*dot.radius, xmlsafe(dot.label)))
+		}
+		svg.WriteString("\n")
+	}
+	svg.WriteString("</svg>")
+	return svg.String()
+}
+
+// hexColour returns the colour given as #rrggbb or #rgb, grey if unreadable
+func hexColour(s string) color.RGBA {
+
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	n, err := strconv.ParseUint(s, 16, 32)
+	if err != nil || len(s) != 6 {
+		return color.RGBA{128, 128, 128, 255}
+	}
+	return color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 255}
+}
+
+// pngMap returns the drawing of the outlines and dots as an image
+func pngMap(v mapView, outlines []Ring, dots []mapDot) *image.RGBA {
+
+	img := image.NewRGBA(image.Rect(0, 0, int(v.width), int(v.height)))
+	bg := color.RGBA{244, 248, 251, 255}
+	for i := range img.Pix {
+		img.Pix[i] = []uint8{bg.R, bg.G, bg.B, bg.A}[i%4]
+	}
+	grey := color.RGBA{136, 136, 136, 255}
+	for _, r := range outlines {
+		if len(r) < 2 || !v.visible(r) {
+			continue
+		}
+		x0, y0 := v.xy(r[0][1], r[0][0])
+		for _, p := range r[1:] {
+			x1, y1 := v.xy(p[1], p[0])
+			drawLine(img, x0, y0, x1, y1, grey)
+			x0, y0 = x1, y1
+		}
+	}
+	for _, dot := range dots {
+		x, y := v.xy(dot.lat, dot.lon)
+		drawDot(img, x, y, dot.radius, hexColour(dot.colour))
+	}
+	return img
+}
+
+// drawDot draws a filled circle, clipped to the image
+func drawDot(img *image.RGBA, x, y, radius float64, c color.RGBA) {
+
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			if dx*dx+dy*dy <= radius*radius {
+				img.SetRGBA(int(x+dx), int(y+dy), c)
+			}
+		}
+	}
+}
+
+// drawLine draws a one pixel line, clipped to the image
+func drawLine(img *image.RGBA, x0, y0, x1, y1 float64, c color.RGBA) {
+
+	steps := math.Ceil(math.Max(math.Abs(x1-x0), math.Abs(y1-y0)))
+	if steps > 4*float64(img.Bounds().Dx()+img.Bounds().Dy()) {
+		return // far off the map
+	}
+	for i := 0.0; i <= steps; i++ {
+		t := 0.0
+		if steps > 0 {
+			t = i / steps
+		}
+		img.SetRGBA(int(x0+(x1-x0)*t), int(y0+(y1-y0)*t), c)
+	}
+}
+
+// drawMap draws the overview map of stream s, writing the SVG, and PNG if
+// wanted, to the output folder
+func drawMap(s int) *MapPage {
+
+	st := CFG.Streams[s]
+	if mp, ok := mapPages[st.StreamID]; ok {
+		return mp
+	}
+	mp := &MapPage{Title: CFG.Map.Title, StreamID: st.StreamID}
+	if mp.Title == "" {
+		mp.Title = "Bonus locations"
+	}
+	mapPages[st.StreamID] = mp
+
+	colours := CFG.Map.Colours
+	if len(colours) == 0 {
+		colours = defaultMapColours
+	}
+	var dots []mapDot
+	legend := make(map[string]int)
+	minLat, minLon, maxLat, maxLon := 90.0, 180.0, -90.0, -180.0
+	for _, B := range fetchBonuses(s) {
+		if !B.ValidCoords {
+			continue
+		}
+		colour := colours[0]
+		if CFG.Map.ColourBy != "" {
+			key := groupKey(B, CFG.Map.ColourBy)
+			if key == "" {
+				key = "none"
+			}
+			ix, ok := legend[key]
+			if !ok {
+				ix = len(mp.Legend)
+				legend[key] = ix
+				mp.Legend = append(mp.Legend, MapLegend{Name: key, Colour: template.CSS(colours[ix%len(colours)])})
+			}
+			mp.Legend[ix].Count++
+			colour = colours[ix%len(colours)]
+		}
+		dots = append(dots, mapDot{lat: B.Lat, lon: B.Lon, colour: colour, label: B.BonusID, radius: 4})
+		minLat, maxLat = math.Min(minLat, B.Lat), math.Max(maxLat, B.Lat)
+		minLon, maxLon = math.Min(minLon, B.Lon), math.Max(maxLon, B.Lon)
+	}
+	mp.Count = len(dots)
+	if len(dots) == 0 {
+		progressf("No bonuses to map [%v]\n", st.StreamID)
+		return mp
+	}
+	v := newMapView(minLat, minLon, maxLat, maxLon, mapWidth, 0.01)
+	outlines := loadMapOutlines()
+	svg := svgMap(v, outlines, dots, !CFG.Map.NoLabels)
+	mp.SVG = template.HTML(svg)
+	mp.Image = st.StreamID + "-map.svg"
+	checkerr(os.WriteFile(filepath.Join(CFG.OutputFolder, mp.Image), []byte(svg), 0644))
+	if CFG.Map.PNG {
+		var buf bytes.Buffer
+		checkerr(png.Encode(&buf, pngMap(v, outlines, dots)))
+		mp.PNGImage = st.StreamID + "-map.png"
+		checkerr(os.WriteFile(filepath.Join(CFG.OutputFolder, mp.PNGImage), buf.Bytes(), 0644))
+	}
+	progressf("%v bonuses mapped [%v]\n", mp.Count, st.StreamID)
+	return mp
+}
+
+// emitMap adds the overview map of the stream named in sf to the book
+func emitMap(sf []string) {
+
+	if len(sf) < 2 {
+		fmt.Println("A map section must name a stream, eg rbook.map.bonuses")
+		return
+	}
+	for sx, v := range CFG.Streams {
+		if v.StreamID != sf[1] || v.Type == type_combo || v.Type == type_entrant {
+			continue
+		}
+		t := builtinTemplate(builtinTemplateName(map_section), mapTemplate)
+		err := OUTF.execute(t, drawMap(sx))
+		if err != nil {
+			fmt.Printf("map %v\n", err)
+		}
+	}
+}
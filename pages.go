@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	_ "embed"
+)
+
+// A page is any div of class 'page', whether opened by rbook itself while
+// paginating a stream or by a static template. Content outside of page divs
+// isn't numbered. This matches the page counter used in document.css.
+
+//go:embed css/running.css
+var css_running string
+
+// Book accumulates the generated HTML so that pages can be numbered and
+// running headers and footers added before it's written to disk. Like a
+// closed file, a nil Book quietly discards anything written to it.
+type Book struct {
+	buf      bytes.Buffer
+	Pages    int  // Number of pages started so far
+	PageRefs bool // Refers to page numbers from a previous pass
+	Headings []TocEntry
+	Index    []*IndexEntry
+	indexed  map[string]*IndexEntry
+}
+
+// PageInfo is passed to the pageHeader and pageFooter templates
+type PageInfo struct {
+	Title       string
+	Description string
+	PageNumber  int
+	PageCount   int
+}
+
+var divTagRE = regexp.MustCompile(`(?i)<div\b[^>]*>`)
+var classAttrRE = regexp.MustCompile(`(?i)\bclass\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+var htmlTagRE = regexp.MustCompile(`<[^>]*>`)
+var headingRE = regexp.MustCompile(`(?is)<h([1-3])\b([^>]*)>(.*?)</h[1-3]\s*>`)
+var idAttrRE = regexp.MustCompile(`(?i)\bid\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// pageTags returns the locations of the opening tags of each page div
+func pageTags(html []byte) [][]int {
+
+	var res [][]int
+	for _, loc := range divTagRE.FindAllIndex(html, -1) {
+		m := classAttrRE.FindSubmatch(html[loc[0]:loc[1]])
+		if m == nil {
+			continue
+		}
+		classes := string(m[1]) + " " + string(m[2])
+		for _, c := range strings.Fields(classes) {
+			if c == "page" {
+				res = append(res, loc)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Write adds p to the book, counting any pages it starts. Page divs split
+// across writes aren't seen so templates are rendered whole using execute.
+func (bk *Book) Write(p []byte) (int, error) {
+
+	if bk == nil {
+		return len(p), nil
+	}
+	bk.Pages += len(pageTags(p))
+	return bk.buf.Write(p)
+}
+
+func (bk *Book) WriteString(s string) (int, error) {
+
+	return bk.Write([]byte(s))
+}
+
+// pageNumber returns the number of the page currently being filled
+func (bk *Book) pageNumber() int {
+
+	if bk == nil {
+		return 0
+	}
+	return bk.Pages
+}
+
+// execute renders t as a single chunk of the book
+func (bk *Book) execute(t *template.Template, data any) error {
+
+	if bk == nil {
+		return nil
+	}
+	var chunk bytes.Buffer
+	err := t.Execute(&chunk, data)
+	bk.Write(chunk.Bytes())
+	return err
+}
+
+// executeSection renders t as a single chunk of the book, noting any h1 - h3
+// headings, with their page numbers, for the table of contents. Headings
+// without an id are given one so that the contents can link to them.
+func (bk *Book) executeSection(t *template.Template, data any) error {
+
+	if bk == nil {
+		return nil
+	}
+	var chunk bytes.Buffer
+	err := t.Execute(&chunk, data)
+	html := chunk.Bytes()
+
+	var res bytes.Buffer
+	pages := pageTags(html)
+	last := 0
+	for _, loc := range headingRE.FindAllSubmatchIndex(html, -1) {
+		pn := bk.Pages
+		for _, p := range pages {
+			if p[0] < loc[0] {
+				pn++
+			}
+		}
+		level := int(html[loc[2]] - '0')
+		attrs := html[loc[4]:loc[5]]
+		text := htmlTagRE.ReplaceAll(html[loc[6]:loc[7]], nil)
+		anchor := ""
+		if m := idAttrRE.FindSubmatch(attrs); m != nil {
+			anchor = string(m[1]) + string(m[2])
+		} else {
+			anchor = fmt.Sprintf("toc-%v", len(bk.Headings)+1)
+			res.Write(html[last:loc[4]])
+			res.WriteString(` id="` + anchor + `"`)
+			last = loc[4]
+		}
+		bk.Headings = append(bk.Headings, TocEntry{Level: level, Heading: cleanText(string(text)), PageNumber: pn, Anchor: anchor})
+	}
+	res.Write(html[last:])
+	bk.buf.Write(res.Bytes())
+	bk.Pages += len(pages)
+	return err
+}
+
+// addHeading adds an entry to the table of contents for the current page
+func (bk *Book) addHeading(level int, heading string) {
+
+	if bk == nil {
+		return
+	}
+	anchor := fmt.Sprintf("toc-%v", len(bk.Headings)+1)
+	bk.buf.WriteString(`<a class="anchor" id="` + anchor + `"></a>`)
+	bk.Headings = append(bk.Headings, TocEntry{Level: level, Heading: heading, PageNumber: bk.Pages, Anchor: anchor})
+}
+
+// indexBonus records the page of the first appearance of a bonus and leaves
+// an anchor there for the index and cross-references to link to
+func (bk *Book) indexBonus(B *Bonus) {
+
+	if bk == nil {
+		return
+	}
+	if bk.indexed == nil {
+		bk.indexed = make(map[string]*IndexEntry)
+	}
+	if _, ok := bk.indexed[B.BonusID]; ok {
+		return
+	}
+	ie := &IndexEntry{BonusID: B.BonusID, BriefDesc: B.BriefDesc, Points: B.Points, StreamID: B.StreamID,
+		PageNumber: B.PageNumber, Anchor: B.Anchor}
+	bk.indexed[B.BonusID] = ie
+	bk.Index = append(bk.Index, ie)
+	bk.buf.WriteString(`<a class="anchor" id="` + B.Anchor + `"></a>`)
+}
+
+// samePages reports whether two passes have laid out the book identically
+func samePages(a *Book, b *Book) bool {
+
+	if a.Pages != b.Pages || len(a.Headings) != len(b.Headings) || len(a.Index) != len(b.Index) {
+		return false
+	}
+	for i := range a.Headings {
+		if a.Headings[i] != b.Headings[i] {
+			return false
+		}
+	}
+	for i := range a.Index {
+		if *a.Index[i] != *b.Index[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// finish returns the completed HTML, imposed if necessary
+func (bk *Book) finish() []byte {
+
+	html := bk.runningHeads()
+	if CFG.Paper.Impose == impose_booklet {
+		html = imposeBooklet(html)
+	}
+	return html
+}
+
+// runningHeads returns the HTML with running headers and footers, if any,
+// inserted at the top of each page
+func (bk *Book) runningHeads() []byte {
+
+	html := bk.buf.Bytes()
+	ht := TPL[CFG.PageHeader]
+	ft := TPL[CFG.PageFooter]
+	if ht == nil && ft == nil {
+		return html
+	}
+
+	var res bytes.Buffer
+	info := PageInfo{Title: CFG.Title, Description: CFG.Description, PageCount: bk.Pages}
+	last := 0
+	for _, loc := range pageTags(html) {
+		res.Write(html[last:loc[1]])
+		last = loc[1]
+		info.PageNumber++
+		if ht != nil {
+			res.WriteString(`<div class="runninghead">`)
+			err := ht.Execute(&res, info)
+			if err != nil {
+				fmt.Printf("pageHeader %v\n", err)
+			}
+			res.WriteString("</div>")
+		}
+		if ft != nil {
+			res.WriteString(`<div class="runningfoot">`)
+			err := ft.Execute(&res, info)
+			if err != nil {
+				fmt.Printf("pageFooter %v\n", err)
+			}
+			res.WriteString("</div>")
+		}
+	}
+	res.Write(html[last:])
+	return res.Bytes()
+}
+
+// bonusRows estimates the number of rows needed by a bonus. Notes and waffle
+// longer than the stream's charsPerRow spill into extra rows.
+func bonusRows(B *Bonus, charsPerRow int) int {
+
+	if charsPerRow < 1 {
+		return 1
+	}
+	text := htmlTagRE.ReplaceAllString(B.Notes+B.Waffle, "")
+	return 1 + utf8.RuneCountInString(text)/charsPerRow
+}
+
+// defaultCharsPerRow is the text taken to fill a row across the page, shared
+// between the row's columns, when the stream doesn't set charsPerRow
+const defaultCharsPerRow = 600
+
+// streamCharsPerRow returns the stream's charsPerRow, the default if it's not
+// set or 0 if it's negative, turning the estimate off
+func streamCharsPerRow(st BonusStream) int {
+
+	switch {
+	case st.CharsPerRow < 0:
+		return 0
+	case st.CharsPerRow > 0:
+		return st.CharsPerRow
+	}
+	return defaultCharsPerRow / max(st.MaxPerLine, 1)
+}
+
+// rowHeight returns the number of rows needed by the tallest of the next
+// cols bonuses
+func rowHeight(bonuses []*Bonus, cols int, charsPerRow int) int {
+
+	res := 1
+	for i := 0; i < cols && i < len(bonuses); i++ {
+		res = max(res, bonusRows(bonuses[i], charsPerRow))
+	}
+	return res
+}
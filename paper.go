@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// PaperParams chooses the size and orientation of the printed page. If no
+// size is given the book is A4, portrait unless 'landscape: true'.
+type PaperParams struct {
+	Size        string  `yaml:"size"`        // A4, A5, Letter, Legal or Custom
+	Orientation string  `yaml:"orientation"` // portrait or landscape
+	Width       float64 `yaml:"width"`       // mm, portrait, Custom only
+	Height      float64 `yaml:"height"`      // mm, portrait, Custom only
+	Impose      string  `yaml:"impose"`      // booklet
+}
+
+const paper_custom = "custom"
+
+type paperSize struct {
+	width, height       float64 // mm, portrait
+	portrait, landscape *string // embedded stylesheets
+}
+
+var paperSizes = map[string]paperSize{
+	"a4":     {210, 297, &css_a4portrait, &css_a4landscape},
+	"a5":     {148, 210, &css_a5portrait, &css_a5landscape},
+	"letter": {215.9, 279.4, &css_letterportrait, &css_letterlandscape},
+	"legal":  {215.9, 355.6, &css_legalportrait, &css_legallandscape},
+}
+
+// Stream rows and columns default to fit photos roughly 105mm x 99mm, three
+// rows of two on an A4 portrait page.
+const defaultCellWidth = 105
+const defaultCellHeight = 99
+
+// pageMarginsHeight is the paper's height less that of a page div, as in the
+// embedded stylesheets
+const pageMarginsHeight = 17
+
+const css_custom = `/*
+ * Custom paper %[1]vmm x %[2]vmm
+ */
+
+@page {
+  margin-top: 0;
+  margin-bottom: 0;
+}
+
+body {
+  width: %[1]vmm;
+}
+
+/* the height of a page div, allowing for the printer's margins */
+.page {
+  height: %[3]vmm;
+}
+
+.newpage {
+  page-break-after: always;
+}
+
+@media print {
+  @page {
+    size: %[1]vmm %[2]vmm;
+    margin: 0;
+  }
+  html,
+  body {
+    height: 100%%;
+  }
+}
+`
+
+// setupPaper checks the paper settings, reconciling them with the older
+// landscape setting, and fills in the default rows and columns of any bonus
+// stream which specifies neither.
+func setupPaper() {
+
+	P := &CFG.Paper
+	explicit := P.Size != ""
+	P.Size = strings.ToLower(P.Size)
+	if P.Size == "" {
+		P.Size = "a4"
+	}
+	P.Orientation = strings.ToLower(P.Orientation)
+	switch P.Orientation {
+	case "":
+		P.Orientation = "portrait"
+		if CFG.Landscape {
+			P.Orientation = "landscape"
+		}
+	case "portrait", "landscape":
+	default:
+		fmt.Printf("Paper orientation must be portrait or landscape, not %v\n", P.Orientation)
+		os.Exit(1)
+	}
+	CFG.Landscape = P.Orientation == "landscape"
+
+	if P.Size == paper_custom {
+		if P.Width <= 0 || P.Height <= 0 {
+			fmt.Println("Custom paper needs width and height in mm")
+			os.Exit(1)
+		}
+	} else if ps, ok := paperSizes[P.Size]; ok {
+		P.Width, P.Height = ps.width, ps.height
+	} else {
+		fmt.Printf("Unknown paper size %v, use A4, A5, Letter, Legal or Custom\n", P.Size)
+		os.Exit(1)
+	}
+
+	P.Impose = strings.ToLower(P.Impose)
+	if P.Impose != "" && P.Impose != impose_booklet {
+		fmt.Printf("Unknown imposition %v, use booklet\n", P.Impose)
+		os.Exit(1)
+	}
+
+	if !explicit {
+		return
+	}
+	w, h := pageDimensions()
+	for i := range CFG.Streams {
+		st := &CFG.Streams[i]
+		if st.Type == type_combo || st.Type == type_entrant || st.MaxPerLine > 0 || st.LinesPerPage > 0 {
+			continue
+		}
+		st.MaxPerLine = max(1, int(math.Round(w/defaultCellWidth)))
+		st.LinesPerPage = max(1, int(math.Round(h/defaultCellHeight)))
+	}
+}
+
+// pageDimensions returns the width and height of the page, in mm, as
+// printed, allowing for orientation
+func pageDimensions() (float64, float64) {
+
+	if CFG.Landscape {
+		return CFG.Paper.Height, CFG.Paper.Width
+	}
+	return CFG.Paper.Width, CFG.Paper.Height
+}
+
+// paperCSS returns the stylesheet for the chosen paper
+func paperCSS() string {
+
+	if ps, ok := paperSizes[CFG.Paper.Size]; ok {
+		if CFG.Landscape {
+			return *ps.landscape
+		}
+		return *ps.portrait
+	}
+	w, h := pageDimensions()
+	return fmt.Sprintf(css_custom, w, h, h-pageMarginsHeight)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/flopp/go-coordsparser"
+)
+
+// CoordsInputParams extends the coordinate formats understood, beyond those
+// of go-coordsparser and OS grid references
+type CoordsInputParams struct {
+	Patterns     []string `yaml:"patterns"`     // regexps with groups lat, lon and optionally latH, lonH
+	PostcodeFile string   `yaml:"postcodeFile"` // CSV of postcode, latitude, longitude
+}
+
+// gridRefRE matches an OS National Grid reference such as SU 123 456 or
+// SU1234545678
+var gridRefRE = regexp.MustCompile(`^([HJNOST][A-HJ-Z])\s*(\d+)\s*(\d*)$`)
+
+// postcodeRE matches a UK postcode
+var postcodeRE = regexp.MustCompile(`^[A-Z]{1,2}[0-9][A-Z0-9]? ?[0-9][A-Z]{2}$`)
+
+var coordsPatterns []*regexp.Regexp
+
+// Postcodes maps each postcode, without spaces, to its position
+var Postcodes map[string][2]float64
+
+// setupCoordsInput compiles the configured patterns
+func setupCoordsInput() {
+
+	for _, p := range CFG.CoordsInput.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			fmt.Printf("Bad coordinates pattern %v\n%v\n", p, err)
+			os.Exit(1)
+		}
+		if re.SubexpIndex("lat") < 0 || re.SubexpIndex("lon") < 0 {
+			fmt.Printf("Coordinates pattern %v needs groups (?P<lat>...) and (?P<lon>...)\n", p)
+			os.Exit(1)
+		}
+		coordsPatterns = append(coordsPatterns, re)
+	}
+}
+
+// parseCoords returns the WGS84 position of coords, trying in turn
+// go-coordsparser, the configured patterns, an OS grid reference and a
+// postcode
+func parseCoords(coords string) (float64, float64, error) {
+
+	lat, lon, err := coordsparser.Parse(cleanCoords(coords))
+	if err == nil {
+		return lat, lon, nil
+	}
+	s := strings.ToUpper(strings.TrimSpace(coords))
+	for _, re := range coordsPatterns {
+		if lat, lon, ok := patternCoords(re, coords); ok {
+			return lat, lon, nil
+		}
+	}
+	if m := gridRefRE.FindStringSubmatch(s); m != nil {
+		if lat, lon, ok := gridRefCoords(m[1], m[2]+m[3]); ok {
+			return lat, lon, nil
+		}
+	}
+	if postcodeRE.MatchString(s) && CFG.CoordsInput.PostcodeFile != "" {
+		if Postcodes == nil {
+			loadPostcodes()
+		}
+		if p, ok := Postcodes[strings.ReplaceAll(s, " ", "")]; ok {
+			return p[0], p[1], nil
+		}
+		return 0, 0, fmt.Errorf("postcode %v not found", s)
+	}
+	return 0, 0, err
+}
+
+// patternCoords applies one of the configured patterns
+func patternCoords(re *regexp.Regexp, coords string) (float64, float64, bool) {
+
+	m := re.FindStringSubmatch(strings.TrimSpace(coords))
+	if m == nil {
+		return 0, 0, false
+	}
+	lat, err1 := strconv.ParseFloat(m[re.SubexpIndex("lat")], 64)
+	lon, err2 := strconv.ParseFloat(m[re.SubexpIndex("lon")], 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	if ix := re.SubexpIndex("latH"); ix >= 0 && strings.EqualFold(m[ix], "S") {
+		lat = -lat
+	}
+	if ix := re.SubexpIndex("lonH"); ix >= 0 && strings.EqualFold(m[ix], "W") {
+		lon = -lon
+	}
+	if math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// gridRefCoords returns the WGS84 position of the centre of the square
+// referred to by the grid letters and an even number of digits
+func gridRefCoords(letters string, digits string) (float64, float64, bool) {
+
+	if len(digits) == 0 || len(digits)%2 != 0 || len(digits) > 10 {
+		return 0, 0, false
+	}
+	l1 := int(letters[0] - 'A')
+	l2 := int(letters[1] - 'A')
+	if l1 > 7 {
+		l1-- // no I
+	}
+	if l2 > 7 {
+		l2--
+	}
+	e100k := ((l1-2)%5)*5 + l2%5
+	n100k := (19 - (l1/5)*5) - l2/5
+	if e100k < 0 || e100k > 6 || n100k < 0 || n100k > 12 {
+		return 0, 0, false
+	}
+	half := len(digits) / 2
+	scale := math.Pow(10, float64(5-half))
+	e, _ := strconv.ParseFloat(digits[:half], 64)
+	n, _ := strconv.ParseFloat(digits[half:], 64)
+	e = float64(e100k)*100000 + e*scale + scale/2
+	n = float64(n100k)*100000 + n*scale + scale/2
+	lat, lon := osgbGrid.unproject(e, n)
+	lat, lon = wgs84ToOSGB36.transform(lat, lon, airy1830, wgs84, true)
+	return lat, lon, true
+}
+
+// loadPostcodes reads the postcode file. Rows whose latitude and longitude
+// can't be read, such as a header, are ignored.
+func loadPostcodes() {
+
+	Postcodes = make(map[string][2]float64)
+	F, err := os.Open(CFG.CoordsInput.PostcodeFile)
+	if err != nil {
+		fmt.Printf("Can't load postcodes: %v\n", err)
+		return
+	}
+	defer F.Close()
+	r := csv.NewReader(F)
+	r.FieldsPerRecord = -1
+	for {
+		rec, err := r.Read()
+		if err != nil {
+			break
+		}
+		if len(rec) < 3 {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+		lon, err2 := strconv.ParseFloat(strings.TrimSpace(rec[2]), 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		Postcodes[strings.ReplaceAll(strings.ToUpper(rec[0]), " ", "")] = [2]float64{lat, lon}
+	}
+	fmt.Printf("%v postcodes loaded\n", len(Postcodes))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"testing"
+)
+
+// gridPosition returns the National Grid easting and northing of a WGS84
+// position
+func gridPosition(lat, lon float64) (float64, float64) {
+
+	lat, lon = wgs84ToOSGB36.transform(lat, lon, wgs84, airy1830, false)
+	return osgbGrid.project(lat, lon)
+}
+
+func TestParseGridRef(t *testing.T) {
+
+	tests := []struct {
+		coords string
+		e, n   float64 // centre of the square
+	}{
+		{"TG 51409 13177", 651409.5, 313177.5}, // the OS worked example
+		{"TG5140913177", 651409.5, 313177.5},
+		{"tg 514 131", 651450, 313150},
+		{"SU 123 456", 412350, 145650},
+		{"NN 16 71", 216500, 771500}, // Ben Nevis
+		{"HU 4 4", 445000, 1145000},
+	}
+	for _, tc := range tests {
+		lat, lon, err := parseCoords(tc.coords)
+		if err != nil {
+			t.Errorf("%v: %v", tc.coords, err)
+			continue
+		}
+		e, n := gridPosition(lat, lon)
+		if math.Abs(e-tc.e) > 0.01 || math.Abs(n-tc.n) > 0.01 {
+			t.Errorf("%v gave %.2f, %.2f, want %v, %v", tc.coords, e, n, tc.e, tc.n)
+		}
+	}
+
+	for _, bad := range []string{"TG 5140 131", "TG51409131771", "IA 123 456", "ZZ 123 456", "SU"} {
+		if _, _, err := parseCoords(bad); err == nil {
+			t.Errorf("%v was accepted", bad)
+		}
+	}
+}
+
+func TestGridRefRoundTrip(t *testing.T) {
+
+	for _, p := range [][2]float64{{50.07, -5.71}, {53.20155, -0.30513}, {57.15, -2.1}, {60.15, -1.15}} {
+		ref := osgbGridRef(p[0], p[1])
+		m := gridRefRE.FindStringSubmatch(ref)
+		if m == nil {
+			t.Errorf("%v gave %q", p, ref)
+			continue
+		}
+		lat, lon, ok := gridRefCoords(m[1], m[2]+m[3])
+		if !ok || distanceMetres(lat, lon, p[0], p[1]) > 1 {
+			t.Errorf("%v via %v came back as %.6f, %.6f", p, ref, lat, lon)
+		}
+	}
+}
+
+func TestPatternCoords(t *testing.T) {
+
+	re := regexp.MustCompile(`^(?P<lat>[0-9.]+)(?P<latH>[NS])/(?P<lon>[0-9.]+)(?P<lonH>[EW])$`)
+	lat, lon, ok := patternCoords(re, " 53.2N/0.305W ")
+	if !ok || lat != 53.2 || lon != -0.305 {
+		t.Errorf("got %v, %v, %v", lat, lon, ok)
+	}
+	if _, _, ok := patternCoords(re, "95N/0.305W"); ok {
+		t.Errorf("latitude 95 was accepted")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// PDFParams configures the conversion of the finished HTML book to PDF by
+// a headless HTML renderer. Fixing the engine, rather than leaving it to be
+// detected, makes the book reproducible from one machine to another.
+type PDFParams struct {
+	OutputPDF string `yaml:"outputFile"`
+	Engine    string `yaml:"engine"`  // weasyprint, wkhtmltopdf or chromium
+	Command   string `yaml:"command"` // path to the engine if not on PATH
+}
+
+const pdf_weasyprint = "weasyprint"
+const pdf_wkhtmltopdf = "wkhtmltopdf"
+const pdf_chromium = "chromium"
+
+// pdfEngines lists the engines tried, in order, if none is configured, with
+// the commands each might be installed as
+var pdfEngines = []struct {
+	engine   string
+	commands []string
+}{
+	{pdf_weasyprint, []string{"weasyprint"}},
+	{pdf_wkhtmltopdf, []string{"wkhtmltopdf"}},
+	{pdf_chromium, []string{"chromium", "chromium-browser", "google-chrome", "google-chrome-stable"}},
+}
+
+// commandEngine returns the engine installed as cmd, judged by its name, or
+// "" if it isn't recognised
+func commandEngine(cmd string) string {
+
+	name := strings.ToLower(filepath.Base(cmd))
+	name = strings.TrimSuffix(name, ".exe")
+	for _, pe := range pdfEngines {
+		for _, c := range pe.commands {
+			if name == c {
+				return pe.engine
+			}
+		}
+	}
+	return ""
+}
+
+// findPDFEngine returns the engine and command to be used
+func findPDFEngine() (string, string, error) {
+
+	if CFG.PDF.Command != "" && CFG.PDF.Engine == "" {
+		engine := commandEngine(CFG.PDF.Command)
+		if engine == "" {
+			return "", "", fmt.Errorf("can't tell which engine %v is, set engine too", CFG.PDF.Command)
+		}
+		return engine, CFG.PDF.Command, nil
+	}
+	for _, pe := range pdfEngines {
+		if CFG.PDF.Engine != "" && CFG.PDF.Engine != pe.engine {
+			continue
+		}
+		if CFG.PDF.Command != "" {
+			return pe.engine, CFG.PDF.Command, nil
+		}
+		for _, cmd := range pe.commands {
+			path, err := exec.LookPath(cmd)
+			if err == nil {
+				return pe.engine, path, nil
+			}
+		}
+	}
+	if CFG.PDF.Engine != "" {
+		return "", "", fmt.Errorf("can't find PDF engine %v", CFG.PDF.Engine)
+	}
+	return "", "", fmt.Errorf("no PDF engine installed, need one of weasyprint, wkhtmltopdf or chromium")
+}
+
+// pdfArgs returns the commandline needed by engine to convert htmlfile.
+// Page size and orientation come from the book's CSS except for wkhtmltopdf
+// which ignores @page and must be told the dimensions.
+func pdfArgs(engine string, htmlfile string, pdffile string) []string {
+
+	switch engine {
+	case pdf_wkhtmltopdf:
+		w, h := sheetDimensions()
+		return []string{"--quiet", "--enable-local-file-access", "--print-media-type", "--disable-smart-shrinking",
+			"--page-width", fmt.Sprintf("%vmm", w), "--page-height", fmt.Sprintf("%vmm", h),
+			"-T", "0", "-B", "0", "-L", "0", "-R", "0", htmlfile, pdffile}
+	case pdf_chromium:
+		return []string{"--headless", "--disable-gpu", "--no-sandbox", "--no-pdf-header-footer",
+			"--print-to-pdf=" + pdffile, "file://" + htmlfile}
+	default:
+		return []string{htmlfile, pdffile}
+	}
+}
+
+// makePDF converts the HTML book to PDF, returning false if it couldn't.
+// The HTML must be in the output folder so that relative image links
+// resolve.
+func makePDF(htmlfile string, pdffile string) bool {
+
+	engine, cmd, err := findPDFEngine()
+	if err != nil {
+		fmt.Printf("Can't generate PDF: %v\n", err)
+		return false
+	}
+	if CFG.PDF.Engine == "" {
+		fmt.Printf("Warning: PDF engine not configured, using %v. Set engine so the book comes out the same elsewhere.\n", engine)
+	}
+	htmlfile, _ = filepath.Abs(htmlfile)
+	pdffile, _ = filepath.Abs(pdffile)
+	fmt.Printf("Generating PDF %v using %v\n", pdffile, engine)
+	out, err := exec.Command(cmd, pdfArgs(engine, htmlfile, pdffile)...).CombinedOutput()
+	if err != nil {
+		fmt.Printf("PDF generation failed: %v\n%v\n", err, strings.TrimSpace(string(out)))
+		return false
+	}
+	if !fileExists(pdffile) {
+		fmt.Printf("PDF generation failed: %v not created\n%v\n", pdffile, strings.TrimSpace(string(out)))
+		return false
+	}
+	return true
+}
+
+// writeTempBook writes the HTML book to a temporary file in the output folder
+// for conversion when no HTML output is wanted. The caller removes it.
+func writeTempBook() string {
+
+	F, err := os.CreateTemp(CFG.OutputFolder, "rbook-*.html")
+	checkerr(err)
+	defer F.Close()
+	F.Write(OUTF.finish())
+	return F.Name()
+}
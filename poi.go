@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+)
+
+// POIParams names the point of interest files, for sat-navs which can't load
+// GPX
+type POIParams struct {
+	OV2        string `yaml:"ov2"`        // TomTom
+	GarminCSV  string `yaml:"garminCSV"`  // Garmin POI Loader
+	PlannerCSV string `yaml:"plannerCSV"` // Kurviger, MyRoute-app and others
+}
+
+const ov2_simple = 2 // TomTom simple POI record
+
+// gpxBonuses returns the bonuses, with valid coordinates, of the bonus
+// streams of gpxStreams
+func gpxBonuses() []*Bonus {
+
+	var res []*Bonus
+	for _, sx := range gpxStreams() {
+		if CFG.Streams[sx].Type == type_combo {
+			continue
+		}
+		for _, B := range fetchBonuses(sx) {
+			if B.ValidCoords {
+				res = append(res, B)
+			}
+		}
+	}
+	return res
+}
+
+// poiComment returns the description of a bonus used by the CSV formats
+func poiComment(B *Bonus) string {
+
+	res := B.Points + " points"
+	if B.Flags != "" {
+		res += " [" + B.Flags + "]"
+	}
+	return res
+}
+
+// latin1 returns s encoded as ISO 8859-1, as TomTom expects, with '?' for
+// anything outside it
+func latin1(s string) []byte {
+
+	var res []byte
+	for _, r := range s {
+		if r > 255 {
+			r = '?'
+		}
+		res = append(res, byte(r))
+	}
+	return res
+}
+
+// writeOV2 writes a TomTom simple POI record for each bonus
+func writeOV2(path string, bonuses []*Bonus) {
+
+	var buf bytes.Buffer
+	for _, B := range bonuses {
+		name := latin1(bonusName(B))
+		buf.WriteByte(ov2_simple)
+		binary.Write(&buf, binary.LittleEndian, int32(13+len(name)+1))
+		binary.Write(&buf, binary.LittleEndian, int32(math.Round(B.Lon*100000)))
+		binary.Write(&buf, binary.LittleEndian, int32(math.Round(B.Lat*100000)))
+		buf.Write(name)
+		buf.WriteByte(0)
+	}
+	checkerr(os.WriteFile(path, buf.Bytes(), 0644))
+}
+
+// writePOICSV writes a CSV file of the bonuses, one row per bonus as
+// returned by row, after the header, if any
+func writePOICSV(path string, bonuses []*Bonus, header []string, row func(B *Bonus) []string) {
+
+	F, err := os.Create(path)
+	checkerr(err)
+	defer F.Close()
+	w := csv.NewWriter(F)
+	if header != nil {
+		w.Write(header)
+	}
+	for _, B := range bonuses {
+		w.Write(row(B))
+	}
+	w.Flush()
+	checkerr(w.Error())
+}
+
+// emitPOIFiles writes each of the point of interest files configured
+func emitPOIFiles() {
+
+	P := CFG.POI
+	if P.OV2 == "" && P.GarminCSV == "" && P.PlannerCSV == "" {
+		return
+	}
+	bonuses := gpxBonuses()
+	if P.OV2 != "" {
+		fmt.Printf("Generating TomTom OV2 %v\n", outputPath(P.OV2))
+		writeOV2(outputPath(P.OV2), bonuses)
+	}
+	if P.GarminCSV != "" {
+		// Garmin POI Loader wants longitude, latitude, name, comment without a header
+		fmt.Printf("Generating Garmin CSV %v\n", outputPath(P.GarminCSV))
+		writePOICSV(outputPath(P.GarminCSV), bonuses, nil, func(B *Bonus) []string {
+			return []string{fmt.Sprint(B.Lon), fmt.Sprint(B.Lat), bonusName(B), poiComment(B)}
+		})
+	}
+	if P.PlannerCSV != "" {
+		fmt.Printf("Generating route planner CSV %v\n", outputPath(P.PlannerCSV))
+		writePOICSV(outputPath(P.PlannerCSV), bonuses, []string{"Name", "Latitude", "Longitude", "Description"}, func(B *Bonus) []string {
+			return []string{bonusName(B), fmt.Sprint(B.Lat), fmt.Sprint(B.Lon), poiComment(B)}
+		})
+	}
+	fmt.Printf("%v bonuses included in POI files\n", len(bonuses))
+}
@@ -4,14 +4,12 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
-	"html/template"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 
-	"github.com/flopp/go-coordsparser"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -28,12 +26,25 @@ var yml = flag.String("cfg", "std.yml", "Name of the YAML configuration")
 var showusage = flag.Bool("?", false, "Show this help")
 var outputfile = flag.String("book", "", "Output filename. Default to YAML config")
 var outputGPX = flag.String("gpx", "", "Output GPX. Default to YAML config")
+var outputPDF = flag.String("pdf", "", "Output PDF. Default to YAML config")
+var outputKML = flag.String("kml", "", "Output KML or KMZ. Default to YAML config")
+var outputGeoJSON = flag.String("geojson", "", "Output GeoJSON. Default to YAML config")
 var database = flag.String("db", "", "ScoreMaster database")
+var validate = flag.Bool("validate", false, "Check bonus coordinates")
+var routeID = flag.String("route", "", "Suggest a route visiting the bonuses of this stream or combo")
+var routeStart = flag.String("start", "", "Start of the route. Default to YAML config")
+var routeFinish = flag.String("finish", "", "Finish of the route. Default to the start")
 var verbose = flag.Bool("v", false, "verbose mode")
 
 var DBH *sql.DB
-var OUTF *os.File
-var GPXF *os.File
+var OUTF *Book
+var GPXF *GPXWriter
+
+// BonusTable holds every bonus in the database, loaded on first use
+var BonusTable map[string]*Bonus
+
+// quiet is set while the book is laid out again
+var quiet bool
 
 func checkerr(err error) {
 	if err != nil {
@@ -49,6 +60,16 @@ func fileExists(x string) bool {
 
 }
 
+// outputPath returns the path of an output file, relative to the output
+// folder unless it includes a folder of its own
+func outputPath(x string) string {
+
+	if strings.ContainsRune(x, filepath.Separator) {
+		return x
+	}
+	return filepath.Join(CFG.OutputFolder, x)
+}
+
 func getStringFromDB(sqlx string, defval string) string {
 
 	rows, err := DBH.Query(sqlx)
@@ -63,7 +84,9 @@ func getStringFromDB(sqlx string, defval string) string {
 	return defval
 }
 
-func init() {
+// setup reads the commandline and the configuration. It's called from main
+// rather than init so that the package can be tested.
+func setup() {
 
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
@@ -83,12 +106,16 @@ func init() {
 
 func main() {
 
+	setup()
+
 	var xfile string
 
 	fmt.Printf("%v   Copyright (c) 2025 Bob Stammers\n", apptitle)
 
 	fmt.Printf("Project folder is %v\n", CFG.ProjectFolder)
 
+	loadTemplates()
+
 	if *database != "" {
 		CFG.Database = *database
 	}
@@ -100,6 +127,20 @@ func main() {
 
 	CFG.Title = getStringFromDB("SELECT RallyTitle FROM rallyparams", CFG.Title)
 
+	loadCategories()
+
+	if *validate || CFG.Validate.Check || CFG.Validate.Strict {
+		if validateCoords() > 0 && CFG.Validate.Strict {
+			fmt.Println("Stopping, coordinates must be corrected")
+			os.Exit(1)
+		}
+	}
+
+	if *routeID != "" {
+		emitRoute(*routeID)
+		return
+	}
+
 	if *outputfile != "" && *outputfile != "none" {
 		if strings.ContainsRune(*outputfile, filepath.Separator) {
 			xfile = *outputfile
@@ -107,8 +148,16 @@ func main() {
 			xfile = filepath.Join(CFG.OutputFolder, *outputfile)
 		}
 		fmt.Printf("\nBook title: %v\n%v\nGenerating %v \n", CFG.Title, CFG.Description, xfile)
-		OUTF, _ = os.Create(xfile)
-		defer OUTF.Close()
+		OUTF = &Book{}
+	}
+
+	pfile := ""
+	if *outputPDF != "" && *outputPDF != "none" {
+		pfile = outputPath(*outputPDF)
+		if OUTF == nil {
+			fmt.Printf("\nBook title: %v\n%v\n", CFG.Title, CFG.Description)
+			OUTF = &Book{}
+		}
 	}
 
 	if *outputGPX == "" {
@@ -116,51 +165,103 @@ func main() {
 	}
 
 	if *outputGPX != "" {
-		yfile := ""
-		if strings.ContainsRune(*outputGPX, filepath.Separator) {
-			yfile = *outputGPX
-		} else {
-			yfile = filepath.Join(CFG.OutputFolder, *outputGPX)
-		}
-
-		fmt.Printf("Generating GPX %v\n", yfile)
+		GPXF = openGPX(outputPath(*outputGPX))
 		fmt.Print("Bonuses in config streams including 'emitGPX: true' are emitted to GPX\n")
-		GPXF, _ = os.Create(yfile)
-		defer GPXF.Close()
-		GPXF.WriteString(gpxheader)
 	}
 
 	fmt.Println()
 
+	pdfOK := true
+	if OUTF != nil {
+		buildBook()
+		for pass := 1; OUTF.PageRefs && !(PREV != nil && samePages(PREV, OUTF)); pass++ {
+			if pass == maxLayoutPasses {
+				fmt.Printf("Warning: page numbers still changing after %v passes, the contents and index may be wrong\n", pass)
+				break
+			}
+			PREV = OUTF
+			relayoutBook()
+		}
+		if xfile != "" {
+			F, err := os.Create(xfile)
+			checkerr(err)
+			F.Write(OUTF.finish())
+			F.Close()
+		}
+		fmt.Printf("%v pages\n", OUTF.Pages)
+		if pfile != "" {
+			hfile := xfile
+			if hfile == "" {
+				hfile = writeTempBook()
+			}
+			pdfOK = makePDF(hfile, pfile)
+			if hfile != xfile {
+				os.Remove(hfile)
+			}
+		}
+	}
+	emitGPXStreams(GPXF)
+	closeGPXFiles()
+	if *outputKML != "" {
+		emitKML(outputPath(*outputKML))
+	}
+	if *outputGeoJSON != "" {
+		emitGeoJSON(outputPath(*outputGeoJSON))
+	}
+	emitPOIFiles()
+	if CFG.Distances.CSVFile != "" {
+		emitDistanceCSV(outputPath(CFG.Distances.CSVFile))
+	}
+	if !pdfOK {
+		os.Exit(1)
+	}
+
+}
+
+// buildBook generates the complete HTML document into a new OUTF
+func buildBook() {
+
+	OUTF = &Book{}
+
 	fmt.Fprint(OUTF, strings.ReplaceAll(htmlhead1, "RBook doc", CFG.Title))
 	fmt.Fprint(OUTF, css_reboot)
-	if CFG.Landscape {
-		fmt.Fprint(OUTF, css_a4landscape)
-	} else {
-		fmt.Fprint(OUTF, css_a4portrait)
+	fmt.Fprint(OUTF, paperCSS())
+	emitTopTail(OUTF, documentCSS)
+	if CFG.PageHeader != "" || CFG.PageFooter != "" {
+		fmt.Fprint(OUTF, css_running)
 	}
-	emitTopTail(OUTF, filepath.Join(CFG.ProjectFolder, "document.css"))
 	fmt.Fprint(OUTF, htmlhead2)
 
 	for i := 0; i < len(CFG.Sections); i++ {
 
 		sf := strings.Split(CFG.Sections[i], ".")
+		if len(sf) > 1 && sf[0] == builtin_prefix {
+			switch sf[1] {
+			case toc_section:
+				emitTOC()
+			case index_section:
+				emitIndex(sf[1:])
+			case map_section:
+				emitMap(sf[1:])
+			case distance_section:
+				emitDistances(sf[1:])
+			default:
+				fmt.Printf("There is no built-in section called %v\n", CFG.Sections[i])
+			}
+			continue
+		}
 		if len(sf) < 2 || sf[0] != stream_prefix {
 
-			xfile = filepath.Join(CFG.ProjectFolder, sf[0]+".html")
-
-			if OUTF != nil {
-				if *verbose {
-					fmt.Printf("Emitting %v\n", sf[0])
-				}
-				emitTopTail(OUTF, xfile)
+			if *verbose {
+				progressf("Emitting %v\n", sf[0])
 			}
+			emitSection(OUTF, sf[0])
 			continue
 		}
 		for sx, v := range CFG.Streams {
 			if v.StreamID == sf[1] {
 				if *verbose {
-					fmt.Printf("Streaming %v\n", sf[1])
+					progressf("Streaming %v\n", sf[1])
 				}
 				fmt.Fprint(OUTF, `<div class="stream`+sf[1]+`">`)
 				switch v.Type {
@@ -169,7 +270,7 @@ func main() {
 				case type_entrant:
 					emitEntrants(sx, sf[1], v.NoPageTop)
 				default:
-					emitBonuses(sx, sf[1], v.NoPageTop, v.EmitGPX)
+					emitBonuses(sx, sf[1], v.NoPageTop)
 				}
 				fmt.Fprint(OUTF, `</div>`)
 			}
@@ -177,13 +278,30 @@ func main() {
 
 	}
 	fmt.Fprint(OUTF, htmlfoot)
-	if GPXF != nil {
-		completeGPX()
-	}
 
 }
 
-func emitBonuses(s int, sf string, nopage bool, emitGPX bool) {
+// relayoutBook builds the book again using the page numbers of the previous
+// pass. Progress messages would only repeat the first pass so are
+// suppressed, warnings and errors are not.
+func relayoutBook() {
+
+	quiet = true
+	defer func() { quiet = false }()
+	buildBook()
+
+}
+
+// progressf reports progress, except while the book is being laid out again
+func progressf(format string, a ...any) {
+
+	if !quiet {
+		fmt.Printf(format, a...)
+	}
+}
+
+// fetchBonuses returns the bonuses selected by stream s
+func fetchBonuses(s int) []*Bonus {
 
 	var sql string
 	if CFG.BonusSQL != "" {
@@ -201,11 +319,32 @@ func emitBonuses(s int, sf string, nopage bool, emitGPX bool) {
 	rows, err := DBH.Query(sql)
 	if err != nil {
 		fmt.Printf("ERROR! %v\nproduced %v\n", sql, err)
-		return
+		return nil
+	}
+	defer rows.Close()
+	var bonuses []*Bonus
+	for rows.Next() {
+		B := scanBonus(rows)
+		B.StreamID = CFG.Streams[s].StreamID
+		if c := B.CoordsIn(CFG.Streams[s].CoordsFormat); c != "" {
+			B.Coords = c
+		}
+		bonuses = append(bonuses, B)
 	}
+	return bonuses
+
+}
+
+func emitBonuses(s int, sf string, nopage bool) {
+
+	bonuses := fetchBonuses(s)
+	t := TPL[streamTemplateName(CFG.Streams[s])]
+
+	groups := groupBonuses(bonuses, CFG.Streams[s].GroupBy)
+	gt := TPL[CFG.Streams[s].GroupHeader]
+
 	NRex := 0
-	NGpx := 0
-	NLines := -1
+	NLines := 0
 	if OUTF != nil {
 		if nopage {
 			OUTF.WriteString("\n<div class='nopage'> <!-- no page -->\n")
@@ -213,123 +352,234 @@ func emitBonuses(s int, sf string, nopage bool, emitGPX bool) {
 			OUTF.WriteString("\n<div class='page'>\n")
 		}
 	}
-	for rows.Next() {
-		B := newBonus()
-		askPoints := 0
-		PointsVal := 0
-
-		err := rows.Scan(&B.BonusID, &B.BriefDesc, &PointsVal, &B.Flags, &B.Notes,
-			&B.Cat1, &B.Cat2, &B.Cat3, &B.Cat4, &B.Cat5, &B.Cat6, &B.Cat7, &B.Cat8, &B.Cat9, &B.Image, &B.Waffle, &B.Coords,
-			&B.Question, &B.Answer, &askPoints)
-		if err != nil {
-			fmt.Printf("%v\n", err)
-		}
+	if CFG.Streams[s].Title != "" {
+		OUTF.addHeading(1, CFG.Streams[s].Title)
+	}
+	for gx, G := range groups {
 
-		B.StreamID = CFG.Streams[s].StreamID
-		B.HasWaffle = B.Waffle != ""
-		B.HasNotes = B.Notes != ""
-		B.AskPoints = askPoints == smAskPointsVar
-		switch askPoints {
-		case smAskPointsVar:
-			B.Points = CFG.AskPointsVarPrefix + strconv.Itoa(PointsVal)
-		case smAskPointsMult:
-			B.Points = CFG.AskPointsMultPrefix + strconv.Itoa(PointsVal)
-		default:
-			B.Points = strconv.Itoa(PointsVal)
-		}
-		if GPXF != nil && emitGPX {
-			B.Lat, B.Lon, err = coordsparser.Parse(cleanCoords(B.Coords))
-			if err != nil {
-				fmt.Printf("%v Coords err:%v\n", B.BonusID, err)
-			} else {
-				writeWaypoint(B.Lat, B.Lon, B.BonusID, B.BriefDesc, PointsVal)
-				NGpx++
+		if CFG.Streams[s].GroupBy != "" {
+			if gx > 0 && CFG.Streams[s].GroupNewPage {
+				if OUTF != nil {
+					OUTF.WriteString("</div><!-- grouppage -->\n<div class='page'>\n")
+				}
+				NLines = 0
 			}
-		}
-
-		u := url.QueryEscape(B.Image)
-		//fmt.Printf("Parsed %v; got %v\n", B.Image, u)
-		B.Image = u
-
-		if CFG.Streams[s].MaxPerLine > 0 {
-			B.NewLine = NRex%CFG.Streams[s].MaxPerLine == 0
-			if B.NewLine {
-				NLines++
-				if NLines >= CFG.Streams[s].LinesPerPage {
-					xx := fmt.Sprintf("Nrex=%v MPL=%v NL=%v NLines=%v LPP=%v", NRex, CFG.Streams[s].MaxPerLine,
-						B.NewLine, NLines, CFG.Streams[s].LinesPerPage)
+			if CFG.Streams[s].MaxPerLine > 0 && gt != nil {
+				if NLines > 0 && NLines+1 > CFG.Streams[s].LinesPerPage {
 					if OUTF != nil {
-						OUTF.WriteString("</div><!-- autopage -->\n<div class='page'><!-- " + xx + " -->\n")
+						OUTF.WriteString("</div><!-- autopage -->\n<div class='page'><!-- group " + G.Name + " -->\n")
 					}
 					NLines = 0
 				}
+				NLines++
 			}
-
+			G.PageNumber = OUTF.pageNumber()
+			if OUTF != nil && gt != nil {
+				err := OUTF.executeSection(gt, G)
+				if err != nil {
+					fmt.Printf("x %v\n", err)
+				}
+			}
+			NRex = 0
 		}
-		NRex++
 
-		B.ImageFolder = CFG.ImageFolder
+		for bx, B := range G.Bonuses {
 
-		setFlags(B)
+			if CFG.Streams[s].MaxPerLine > 0 {
+				B.NewLine = NRex%CFG.Streams[s].MaxPerLine == 0
+				if B.NewLine {
+					h := rowHeight(G.Bonuses[bx:], CFG.Streams[s].MaxPerLine, streamCharsPerRow(CFG.Streams[s]))
+					if h > CFG.Streams[s].LinesPerPage {
+						warnTallRow(sf, B.BonusID, h)
+					}
+					if NLines > 0 && NLines+h > CFG.Streams[s].LinesPerPage {
+						xx := fmt.Sprintf("Nrex=%v MPL=%v NL=%v NLines=%v LPP=%v", NRex, CFG.Streams[s].MaxPerLine,
+							B.NewLine, NLines, CFG.Streams[s].LinesPerPage)
+						if OUTF != nil {
+							OUTF.WriteString("</div><!-- autopage -->\n<div class='page'><!-- " + xx + " -->\n")
+						}
+						NLines = 0
+					}
+					NLines += h
+				}
 
-		streamTemplate := sf
-		if CFG.Streams[s].TemplateID != "" {
-			streamTemplate = CFG.Streams[s].TemplateID
-		}
-		xfile := filepath.Join(CFG.ProjectFolder, streamTemplate+".html")
-		if !fileExists(xfile) {
-			fmt.Printf("Stream %v has no template %v\n", CFG.Streams[s].StreamID, xfile)
-			rows.Close()
-			return
-		}
-		t, err := template.ParseFiles(xfile)
-		if err != nil {
-			fmt.Printf("Parsing error (%v) in %v\n", err, xfile)
-		}
-		if OUTF != nil {
-			err = t.Execute(OUTF, B)
-			if err != nil {
-				fmt.Printf("x %v\n", err)
+			}
+			NRex++
+			B.PageNumber = OUTF.pageNumber()
+			if CFG.Streams[s].LocatorMaps {
+				B.MapImage = locatorMap(B)
+			}
+			if !CFG.Streams[s].NoIndex {
+				OUTF.indexBonus(B)
+			}
+
+			if OUTF != nil {
+				err := OUTF.execute(t, B)
+				if err != nil {
+					fmt.Printf("x %v\n", err)
+				}
 			}
 		}
 	}
-	if NLines < CFG.Streams[s].LinesPerPage {
-		NLines++
-	}
 	OUTF.WriteString("</div>")
-	fmt.Printf("\n%v bonus records processed [%v]\n", NRex, sf)
-	if *outputGPX != "" {
-		fmt.Printf("%v bonuses included in GPX\n", NGpx)
+	progressf("\n%v bonus records processed [%v]\n", len(bonuses), sf)
+	if len(groups) > 1 {
+		progressf("%v groups by %v\n", len(groups), CFG.Streams[s].GroupBy)
 	}
-	rows.Close()
 
 }
 
-func emitCombos(s int, sf string) {
+// tallRows records the stream and first bonus of each warning given by
+// warnTallRow, so that each is given only once
+var tallRows = make(map[string]bool)
 
-	var sql string
-	if CFG.ComboSQL != "" {
-		sql = CFG.ComboSQL
-	} else {
-		sql = ComboSQL
+// warnTallRow complains that the row starting with bonusid needs more rows
+// than the stream's rowsPerPage so will overflow its page
+func warnTallRow(sf string, bonusid string, rows int) {
+
+	key := sf + "\x00" + bonusid
+	if tallRows[key] {
+		return
 	}
+	tallRows[key] = true
+	fmt.Printf("Warning: the row starting with bonus %v [%v] needs about %v rows, more than rowsPerPage\n", bonusid, sf, rows)
+}
+
+// scanBonus builds a bonus from the current row of rows, which must
+// match the column layout of BonusSQL.
+func scanBonus(rows *sql.Rows) *Bonus {
+
+	B := newBonus()
+	askPoints := 0
+
+	err := rows.Scan(&B.BonusID, &B.BriefDesc, &B.PointsValue, &B.Flags, &B.Notes,
+		&B.Cat1, &B.Cat2, &B.Cat3, &B.Cat4, &B.Cat5, &B.Cat6, &B.Cat7, &B.Cat8, &B.Cat9, &B.Image, &B.Waffle, &B.Coords,
+		&B.Question, &B.Answer, &askPoints)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+	}
+
+	B.HasWaffle = B.Waffle != ""
+	B.HasNotes = B.Notes != ""
+	B.Categories = resolveCategories(B.Cat1, B.Cat2, B.Cat3, B.Cat4, B.Cat5, B.Cat6, B.Cat7, B.Cat8, B.Cat9)
+	B.AskPoints = askPoints == smAskPointsVar
+	switch askPoints {
+	case smAskPointsVar:
+		B.Points = CFG.AskPointsVarPrefix + strconv.Itoa(B.PointsValue)
+	case smAskPointsMult:
+		B.Points = CFG.AskPointsMultPrefix + strconv.Itoa(B.PointsValue)
+	default:
+		B.Points = strconv.Itoa(B.PointsValue)
+	}
+
+	u := url.QueryEscape(B.Image)
+	//fmt.Printf("Parsed %v; got %v\n", B.Image, u)
+	B.Image = u
+
+	B.ImageFolder = CFG.ImageFolder
+
+	setFlags(B)
+
+	B.OriginalCoords = B.Coords
+	B.Lat, B.Lon, B.coordsErr = parseCoords(B.Coords)
+	B.ValidCoords = B.coordsErr == nil
+	B.Anchor = bonusAnchor(B.BonusID)
+
+	return B
+}
+
+// loadBonusTable reads every bonus in the database, keyed by BonusID, so
+// that combos can refer to the full details of their member bonuses.
+func loadBonusTable() {
+
+	BonusTable = make(map[string]*Bonus)
+
+	sql := CFG.BonusSQL
+	if sql == "" {
+		sql = BonusSQL
+	}
+	rows, err := DBH.Query(sql)
+	if err != nil {
+		fmt.Printf("ERROR! %v\nproduced %v\n", sql, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		B := scanBonus(rows)
+		BonusTable[B.BonusID] = B
+	}
+}
+
+// missingComboBonuses records the combo and bonus of each warning given by
+// setComboBonuses, so that each is given only once
+var missingComboBonuses = make(map[string]bool)
+
+// setComboBonuses fills B.Bonuses from its BonusList, complaining
+// once about any BonusID that isn't in the bonus table.
+func setComboBonuses(B *Combo) {
+
+	if BonusTable == nil {
+		loadBonusTable()
+	}
+	B.Bonuses = nil
+	for _, id := range strings.Split(B.BonusList, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		b, ok := BonusTable[id]
+		if !ok {
+			key := B.ComboID + "\x00" + id
+			if !missingComboBonuses[key] {
+				missingComboBonuses[key] = true
+				fmt.Printf("Warning: combo %v refers to bonus %v which does not exist\n", B.ComboID, id)
+			}
+			continue
+		}
+		B.Bonuses = append(B.Bonuses, newComboBonus(b))
+	}
+}
+
+// fetchCombos returns the combos selected by stream s, complete with their
+// member bonuses
+func fetchCombos(s int) []*Combo {
+
+	sql := comboSQL()
 	if CFG.Streams[s].WhereString != "" {
 		sql += " WHERE " + CFG.Streams[s].WhereString
 	}
 	if CFG.Streams[s].BonusOrder != "" {
 		sql += " ORDER BY " + CFG.Streams[s].BonusOrder
 	}
+	combos := queryCombos(sql)
+	for _, B := range combos {
+		B.StreamID = CFG.Streams[s].StreamID
+	}
+	return combos
+
+}
+
+// comboSQL returns the query for combos, the config's comboSQL if set
+func comboSQL() string {
+
+	if CFG.ComboSQL != "" {
+		return CFG.ComboSQL
+	}
+	return ComboSQL
+}
+
+// queryCombos returns the combos selected by sql, which must match the
+// column layout of ComboSQL
+func queryCombos(sql string) []*Combo {
+
 	//fmt.Printf("%v\n", sql)
 	rows, err := DBH.Query(sql)
 	if err != nil {
 		fmt.Printf("ERROR! %v\nproduced %v\n", sql, err)
-		return
-	}
-	NRex := 0
-	NLines := -1
-	if OUTF != nil && false {
-		OUTF.WriteString("<div class='page'>")
+		return nil
 	}
+	defer rows.Close()
+	var combos []*Combo
 	for rows.Next() {
 
 		B := newCombo()
@@ -340,17 +590,41 @@ func emitCombos(s int, sf string) {
 			fmt.Printf("%v\n", err)
 		}
 
+		B.Categories = resolveCategories(B.Cat1, B.Cat2, B.Cat3, B.Cat4, B.Cat5, B.Cat6, B.Cat7, B.Cat8, B.Cat9)
+		setComboBonuses(B)
+
 		if B.MinimumTicks > 0 {
 			expandComboPoints(B)
 			//fmt.Printf("%v %v %v\n", B.ComboID, B.MinimumTicks, B.ScorePoints)
 		}
-		B.StreamID = CFG.Streams[s].StreamID
+		combos = append(combos, B)
+	}
+	return combos
+
+}
+
+func emitCombos(s int, sf string) {
+
+	combos := fetchCombos(s)
+	t := TPL[streamTemplateName(CFG.Streams[s])]
+	NRex := 0
+	NLines := 0
+	if OUTF != nil && false {
+		OUTF.WriteString("<div class='page'>")
+	}
+	if CFG.Streams[s].Title != "" {
+		OUTF.addHeading(1, CFG.Streams[s].Title)
+	}
+	for _, B := range combos {
+
+		for i := range B.Bonuses {
+			B.Bonuses[i].PageNumber, B.Bonuses[i].Anchor = bonusRef(B.Bonuses[i].BonusID)
+		}
 
 		if CFG.Streams[s].MaxPerLine > 0 {
 			B.NewLine = NRex%CFG.Streams[s].MaxPerLine == 0
 			if B.NewLine {
-				NLines++
-				if NLines >= CFG.Streams[s].LinesPerPage {
+				if NLines > 0 && NLines+1 > CFG.Streams[s].LinesPerPage {
 					xx := fmt.Sprintf("Nrex=%v MPL=%v NL=%v NLines=%v LPP=%v", NRex, CFG.Streams[s].MaxPerLine,
 						B.NewLine, NLines, CFG.Streams[s].LinesPerPage)
 					if OUTF != nil {
@@ -358,36 +632,24 @@ func emitCombos(s int, sf string) {
 					}
 					NLines = 0
 				}
+				NLines++
 			}
 		}
 
 		NRex++
+		B.PageNumber = OUTF.pageNumber()
 
-		xfile := filepath.Join(CFG.ProjectFolder, sf+".html")
-		if !fileExists(xfile) {
-			fmt.Printf("Stream %v has no template %v\n", CFG.Streams[s].StreamID, xfile)
-			rows.Close()
-			return
-		}
-		t, err := template.ParseFiles(xfile)
-		if err != nil {
-			fmt.Printf("Parsing error (%v) in %v\n", err, xfile)
-		}
 		if OUTF != nil {
-			err = t.Execute(OUTF, B)
+			err := OUTF.execute(t, B)
 			if err != nil {
 				fmt.Printf("x %v\n", err)
 			}
 		}
 	}
-	if NLines < CFG.Streams[s].LinesPerPage {
-		NLines++
-	}
 	if OUTF != nil {
 		OUTF.WriteString("</div>")
 	}
-	fmt.Printf("%v Combo records processed [%v]\n", NRex, sf)
-	rows.Close()
+	progressf("%v Combo records processed [%v]\n", NRex, sf)
 
 }
 
@@ -411,8 +673,9 @@ func emitEntrants(s int, sf string, nopage bool) {
 		fmt.Printf("ERROR! %v\nproduced %v\n", sql, err)
 		return
 	}
+	t := TPL[streamTemplateName(CFG.Streams[s])]
 	NRex := 0
-	NLines := -1
+	NLines := 0
 	if OUTF != nil {
 		if nopage {
 			OUTF.WriteString("\n<div class='nopage'> <!-- no page -->\n")
@@ -420,6 +683,9 @@ func emitEntrants(s int, sf string, nopage bool) {
 			OUTF.WriteString("\n<div class='page'>\n")
 		}
 	}
+	if CFG.Streams[s].Title != "" {
+		OUTF.addHeading(1, CFG.Streams[s].Title)
+	}
 	for rows.Next() {
 		E := newEntrant()
 		odoKms := 0
@@ -435,8 +701,7 @@ func emitEntrants(s int, sf string, nopage bool) {
 		if CFG.Streams[s].MaxPerLine > 0 {
 			E.NewLine = NRex%CFG.Streams[s].MaxPerLine == 0
 			if E.NewLine {
-				NLines++
-				if NLines >= CFG.Streams[s].LinesPerPage {
+				if NLines > 0 && NLines+1 > CFG.Streams[s].LinesPerPage {
 					xx := fmt.Sprintf("Nrex=%v MPL=%v NL=%v NLines=%v LPP=%v", NRex, CFG.Streams[s].MaxPerLine,
 						E.NewLine, NLines, CFG.Streams[s].LinesPerPage)
 					if OUTF != nil {
@@ -444,57 +709,54 @@ func emitEntrants(s int, sf string, nopage bool) {
 					}
 					NLines = 0
 				}
+				NLines++
 			}
 		}
 
 		NRex++
 
 		E.ImageFolder = CFG.ImageFolder
+		E.PageNumber = OUTF.pageNumber()
 
-		streamTemplate := sf
-		if CFG.Streams[s].TemplateID != "" {
-			streamTemplate = CFG.Streams[s].TemplateID
-		}
-		xfile := filepath.Join(CFG.ProjectFolder, streamTemplate+".html")
-		if !fileExists(xfile) {
-			fmt.Printf("Stream %v has no template %v\n", CFG.Streams[s].StreamID, xfile)
-			rows.Close()
-			return
-		}
-		t, err := template.ParseFiles(xfile)
-		if err != nil {
-			fmt.Printf("Parsing error (%v) in %v\n", err, xfile)
-		}
 		if OUTF != nil {
-			err = t.Execute(OUTF, E)
+			err = OUTF.execute(t, E)
 			if err != nil {
 				fmt.Printf("x %v\n", err)
 			}
 		}
 	}
-	if NLines < CFG.Streams[s].LinesPerPage {
-		NLines++
-	}
 	if OUTF != nil {
 		OUTF.WriteString("</div>")
 	}
-	fmt.Printf("%v entrant records processed\n", NRex)
+	progressf("%v entrant records processed\n", NRex)
 	rows.Close()
 
 }
 
-func emitTopTail(F *os.File, xfile string) {
+// emitSection renders a static section, noting its headings for the
+// table of contents
+func emitSection(F *Book, tname string) {
 
-	if !fileExists(xfile) {
+	html, ok := TPL[tname]
+	if !ok {
 		return
 	}
-	html, err := template.ParseFiles(xfile)
+	err := F.executeSection(html, CFG)
 	if err != nil {
-		fmt.Printf("Error (%v) in static file %v\n", err, xfile)
+		fmt.Printf("emitSection [%v] %v\n", tname, err)
+	}
+
+}
+
+func emitTopTail(F *Book, tname string) {
+
+	html, ok := TPL[tname]
+	if !ok {
+		return
 	}
-	err = html.Execute(F, CFG)
+	err := F.execute(html, CFG)
 	if err != nil {
-		fmt.Printf("emitTopTail [%v] %v\n", xfile, err)
+		fmt.Printf("emitTopTail [%v] %v\n", tname, err)
 	}
 
 }
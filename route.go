@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+)
+
+// RouteParams configures the routes suggested by -route, which visit every
+// bonus of a stream or combo in roughly the shortest order
+type RouteParams struct {
+	Start    string `yaml:"start"`    // coordinates, in any accepted notation
+	Finish   string `yaml:"finish"`   // default the start
+	GPXFile  string `yaml:"gpxFile"`  // default route.gpx
+	HTMLFile string `yaml:"htmlFile"` // default route.html
+}
+
+const defaultRouteGPX = "route.gpx"
+const defaultRouteHTML = "route.html"
+
+// RouteLeg is one stop on a suggested route
+type RouteLeg struct {
+	Seq       int
+	BonusID   string
+	BriefDesc string
+	Coords    string
+	Points    string
+	Leg       float64 // from the previous stop
+	Total     float64 // from the start
+}
+
+// RoutePage is passed to the route template
+type RoutePage struct {
+	Title string
+	Units string
+	Total float64
+	Legs  []RouteLeg
+}
+
+const routeTemplate = `
+<div class="route">
+<h3>{{.Title}}</h3>
+<p>{{len .Legs}} stops, {{printf "%.1f" .Total}} {{.Units}} as the crow flies</p>
+<table class="route">
+<tr><th></th><th>Bonus</th><th></th><th>Coords</th><th>Points</th><th>Leg</th><th>Total</th></tr>
+{{range .Legs}}<tr><td>{{.Seq}}</td><td>{{.BonusID}}</td><td>{{.BriefDesc}}</td><td>{{.Coords}}</td><td>{{.Points}}</td><td>{{printf "%.1f" .Leg}}</td><td>{{printf "%.1f" .Total}}</td></tr>
+{{end}}</table>
+</div>
+`
+
+const routeCSS = `
+table.route { border-collapse: collapse; }
+table.route td, table.route th { border: 1px solid #999; padding: 0 .3em; }
+`
+
+// routePoint returns the start or finish as a pseudo bonus, or nil if the
+// coordinates are missing or can't be read
+func routePoint(name string, coords string) *Bonus {
+
+	if coords == "" {
+		return nil
+	}
+	B := newBonus()
+	B.BonusID = name
+	B.BriefDesc = name
+	B.Points = ""
+	B.Coords = coords
+	B.Lat, B.Lon, B.coordsErr = parseCoords(coords)
+	B.ValidCoords = B.coordsErr == nil
+	if !B.ValidCoords {
+		fmt.Printf("%v coordinates %v: %v\n", name, coords, B.coordsErr)
+		return nil
+	}
+	return B
+}
+
+// routeBonuses returns the bonuses of the stream, or failing that the combo,
+// named by id together with a description of them
+func routeBonuses(id string) ([]*Bonus, string) {
+
+	for sx, v := range CFG.Streams {
+		if v.StreamID == id && v.Type != type_combo && v.Type != type_entrant {
+			title := v.Title
+			if title == "" {
+				title = "Stream " + id
+			}
+			return fetchBonuses(sx), title
+		}
+	}
+	for _, C := range queryCombos(comboSQL()) {
+		if C.ComboID != id {
+			continue
+		}
+		var res []*Bonus
+		for _, cb := range C.Bonuses {
+			res = append(res, BonusTable[cb.BonusID])
+		}
+		return res, C.ComboID + " " + C.BriefDesc
+	}
+	return nil, ""
+}
+
+// routeDistance is the distance between two stops, a missing start or finish
+// being no distance from anywhere so that the route may begin or end at any
+// bonus
+func routeDistance(a, b *Bonus) float64 {
+
+	if a == nil || b == nil {
+		return 0
+	}
+	return distanceMetres(a.Lat, a.Lon, b.Lat, b.Lon)
+}
+
+// suggestRoute orders the bonuses between start and finish, either of which
+// may be nil, by visiting the nearest bonus not yet visited and then
+// improving the result with 2-opt until no reversal of any part of it makes
+// the route shorter
+func suggestRoute(start, finish *Bonus, bonuses []*Bonus) []*Bonus {
+
+	route := []*Bonus{start}
+	todo := append([]*Bonus{}, bonuses...)
+	for len(todo) > 0 {
+		here := route[len(route)-1]
+		next := 0
+		for i := range todo {
+			if routeDistance(here, todo[i]) < routeDistance(here, todo[next]) {
+				next = i
+			}
+		}
+		route = append(route, todo[next])
+		todo = append(todo[:next], todo[next+1:]...)
+	}
+	route = append(route, finish)
+
+	for improved := true; improved; {
+		improved = false
+		for i := 1; i < len(route)-2; i++ {
+			for j := i + 1; j < len(route)-1; j++ {
+				delta := routeDistance(route[i-1], route[j]) + routeDistance(route[i], route[j+1]) -
+					routeDistance(route[i-1], route[i]) - routeDistance(route[j], route[j+1])
+				if delta < -0.01 {
+					for a, b := i, j; a < b; a, b = a+1, b-1 {
+						route[a], route[b] = route[b], route[a]
+					}
+					improved = true
+				}
+			}
+		}
+	}
+
+	var res []*Bonus
+	for _, B := range route {
+		if B != nil {
+			res = append(res, B)
+		}
+	}
+	return res
+}
+
+// emitRoute suggests a route visiting the bonuses of the stream or combo
+// named by id, writing it as a GPX route and an HTML table
+func emitRoute(id string) {
+
+	bonuses, title := routeBonuses(id)
+	if title == "" {
+		fmt.Printf("There is no bonus stream or combo called %v\n", id)
+		os.Exit(1)
+	}
+	var visit []*Bonus
+	for _, B := range bonuses {
+		if B.ValidCoords {
+			visit = append(visit, B)
+		} else {
+			fmt.Printf("%v left out of the route, coordinates %v can't be read\n", B.BonusID, B.Coords)
+		}
+	}
+	if *routeStart == "" {
+		*routeStart = CFG.Route.Start
+	}
+	if *routeFinish == "" {
+		*routeFinish = CFG.Route.Finish
+	}
+	if *routeFinish == "" {
+		*routeFinish = *routeStart
+	}
+	start := routePoint("Start", *routeStart)
+	finish := routePoint("Finish", *routeFinish)
+
+	route := suggestRoute(start, finish, visit)
+	pg := RoutePage{Title: title, Units: distanceUnits()}
+	var prev *Bonus
+	for i, B := range route {
+		leg := RouteLeg{Seq: i + 1, BonusID: B.BonusID, BriefDesc: B.BriefDesc, Coords: B.Coords, Points: B.Points}
+		if prev != nil {
+			leg.Leg = roundDistance(distanceBetween(prev, B))
+			pg.Total += distanceBetween(prev, B)
+		}
+		leg.Total = roundDistance(pg.Total)
+		pg.Legs = append(pg.Legs, leg)
+		prev = B
+	}
+	pg.Total = roundDistance(pg.Total)
+
+	gpath := CFG.Route.GPXFile
+	if gpath == "" {
+		gpath = defaultRouteGPX
+	}
+	gw := openGPX(outputPath(gpath))
+	for _, B := range visit {
+		writeWaypoint(gw, B)
+	}
+	writeRoute(gw, title, fmt.Sprintf("%.1f %v", pg.Total, pg.Units), route)
+	closeGPXFiles()
+
+	hpath := CFG.Route.HTMLFile
+	if hpath == "" {
+		hpath = defaultRouteHTML
+	}
+	hpath = outputPath(hpath)
+	var buf bytes.Buffer
+	buf.WriteString(strings.ReplaceAll(htmlhead1, "RBook doc", template.HTMLEscapeString(title)))
+	buf.WriteString(css_reboot)
+	buf.WriteString(routeCSS)
+	buf.WriteString(htmlhead2)
+	t := template.Must(template.New("route").Funcs(templateFuncs).Parse(routeTemplate))
+	checkerr(t.Execute(&buf, pg))
+	buf.WriteString(htmlfoot)
+	fmt.Printf("Generating %v\n", hpath)
+	checkerr(os.WriteFile(hpath, buf.Bytes(), 0644))
+
+	fmt.Printf("Route of %v bonuses [%v], %.1f %v\n", len(visit), id, pg.Total, pg.Units)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	_ "time/tzdata" // zones are known without the operating system's database
+)
+
+// DaylightParams configures the sunrise and sunset times offered to
+// templates, usually for bonuses which may only be claimed in daylight or at
+// night
+type DaylightParams struct {
+	StartDate  string `yaml:"startDate"`  // YYYY-MM-DD, default rallyparams StartTime
+	FinishDate string `yaml:"finishDate"` // default rallyparams FinishTime
+	TimeZone   string `yaml:"timeZone"`   // eg Europe/London, default the computer's
+	TimeFormat string `yaml:"timeFormat"` // Go layout, default 15:04
+	DateFormat string `yaml:"dateFormat"` // default Mon 2 Jan
+}
+
+const defaultSunTimeFormat = "15:04"
+const defaultSunDateFormat = "Mon 2 Jan"
+
+// Sun altitudes, in degrees, at which each event happens. Sunrise and sunset
+// allow for refraction and the size of the sun.
+const sunriseAltitude = -0.833
+const civilAltitude = -6
+
+// SunTimes is the daylight at a bonus on one day of the rally. Times are
+// blank if the sun doesn't rise or set that day.
+type SunTimes struct {
+	Date    string
+	Dawn    string // civil twilight begins
+	Sunrise string
+	Sunset  string
+	Dusk    string // civil twilight ends
+}
+
+var rallyDates []time.Time
+var rallyZone *time.Location
+
+// setupDaylight works out the rally's dates and time zone, once
+func setupDaylight() {
+
+	if rallyZone != nil {
+		return
+	}
+	rallyZone = time.Local
+	if CFG.Daylight.TimeZone != "" {
+		loc, err := time.LoadLocation(CFG.Daylight.TimeZone)
+		if err != nil {
+			fmt.Printf("Time zone %v: %v\n", CFG.Daylight.TimeZone, err)
+		} else {
+			rallyZone = loc
+		}
+	}
+	start := CFG.Daylight.StartDate
+	if start == "" {
+		start = getStringFromDB("SELECT IfNull(StartTime,'') FROM rallyparams", "")
+	}
+	finish := CFG.Daylight.FinishDate
+	if finish == "" {
+		finish = getStringFromDB("SELECT IfNull(FinishTime,'') FROM rallyparams", start)
+	}
+	first, err := time.Parse(time.DateOnly, start[:min(len(start), len(time.DateOnly))])
+	if err != nil {
+		fmt.Printf("Can't work out daylight, rally start date %v: %v\n", start, err)
+		return
+	}
+	last, err := time.Parse(time.DateOnly, finish[:min(len(finish), len(time.DateOnly))])
+	if err != nil || last.Before(first) {
+		last = first
+	}
+	for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+		rallyDates = append(rallyDates, d)
+	}
+}
+
+// Daylight is available to templates as {{.Daylight}}, giving the times of
+// dawn, sunrise, sunset and dusk at the bonus on each day of the rally
+func (B *Bonus) Daylight() []SunTimes {
+
+	if !B.ValidCoords {
+		return nil
+	}
+	setupDaylight()
+	tf := CFG.Daylight.TimeFormat
+	if tf == "" {
+		tf = defaultSunTimeFormat
+	}
+	df := CFG.Daylight.DateFormat
+	if df == "" {
+		df = defaultSunDateFormat
+	}
+	clock := func(t time.Time, ok bool) string {
+		if !ok {
+			return ""
+		}
+		return t.In(rallyZone).Format(tf)
+	}
+	var res []SunTimes
+	for _, d := range rallyDates {
+		st := SunTimes{Date: d.Format(df)}
+		st.Sunrise, st.Sunset = clock(sunEvent(d, B.Lat, B.Lon, sunriseAltitude, false)), clock(sunEvent(d, B.Lat, B.Lon, sunriseAltitude, true))
+		st.Dawn, st.Dusk = clock(sunEvent(d, B.Lat, B.Lon, civilAltitude, false)), clock(sunEvent(d, B.Lat, B.Lon, civilAltitude, true))
+		res = append(res, st)
+	}
+	return res
+}
+
+// sunEvent returns the time on date d at which the sun passes through the
+// given altitude, rising or setting, at the position given. It uses the
+// sunrise equation, accurate to a minute or so away from the poles, and
+// returns false if the sun doesn't reach the altitude that day.
+func sunEvent(d time.Time, lat, lon, altitude float64, setting bool) (time.Time, bool) {
+
+	const j2000 = 2451545.0
+	const unixEpoch = 2440587.5 // Julian date of 1970-01-01
+	jd := float64(time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC).Unix())/86400 + unixEpoch
+	n := math.Ceil(jd - j2000 + 0.0008)
+	noon := n - lon/360 // mean solar noon
+	m := math.Mod(357.5291+0.98560028*noon, 360) * rad
+	c := 1.9148*math.Sin(m) + 0.02*math.Sin(2*m) + 0.0003*math.Sin(3*m)
+	lambda := math.Mod(m/rad+c+180+102.9372, 360) * rad
+	transit := j2000 + noon + 0.0053*math.Sin(m) - 0.0069*math.Sin(2*lambda)
+	decl := math.Asin(math.Sin(lambda) * math.Sin(23.4397*rad))
+	cosh := (math.Sin(altitude*rad) - math.Sin(lat*rad)*math.Sin(decl)) / (math.Cos(lat*rad) * math.Cos(decl))
+	if cosh < -1 || cosh > 1 {
+		return time.Time{}, false
+	}
+	h := math.Acos(cosh) / rad / 360
+	if !setting {
+		h = -h
+	}
+	secs := (transit + h - unixEpoch) * 86400
+	return time.Unix(int64(math.Round(secs)), 0), true
+}
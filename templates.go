@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TPL holds every template used by this run, parsed once before any output
+// is generated. Static sections are keyed by section name, streams by their
+// TemplateID (or StreamID if no template is specified).
+var TPL = make(map[string]*template.Template)
+
+// templateFuncs are available to every template
+var templateFuncs = template.FuncMap{
+	"bonusPage": bonusPage,
+	"bonusLink": bonusLink,
+}
+
+// documentCSS is the key of the project's custom stylesheet in TPL
+const documentCSS = "document.css"
+
+func streamTemplateName(bs BonusStream) string {
+
+	if bs.TemplateID != "" {
+		return bs.TemplateID
+	}
+	return bs.StreamID
+}
+
+// loadTemplates parses the project stylesheet and the templates of every
+// section listed in the config. Any syntax error is reported, with file and
+// line, and stops the run before any output is produced.
+func loadTemplates() {
+
+	parseTemplate(documentCSS, filepath.Join(CFG.ProjectFolder, documentCSS), false)
+	for _, tname := range []string{CFG.PageHeader, CFG.PageFooter} {
+		if tname != "" {
+			parseTemplate(tname, filepath.Join(CFG.ProjectFolder, tname+".html"), true)
+		}
+	}
+	if CFG.KML.Balloon != "" {
+		parseTemplate(CFG.KML.Balloon, filepath.Join(CFG.ProjectFolder, CFG.KML.Balloon+".html"), true)
+	}
+	parseNameTemplate()
+
+	for _, section := range CFG.Sections {
+		sf := strings.Split(section, ".")
+		if len(sf) > 1 && sf[0] == builtin_prefix {
+			tname := builtinTemplateName(sf[1])
+			parseTemplate(tname, filepath.Join(CFG.ProjectFolder, tname+".html"), false)
+			continue
+		}
+		if len(sf) < 2 || sf[0] != stream_prefix {
+			parseTemplate(sf[0], filepath.Join(CFG.ProjectFolder, sf[0]+".html"), false)
+			continue
+		}
+		for _, v := range CFG.Streams {
+			if v.StreamID != sf[1] {
+				continue
+			}
+			tname := streamTemplateName(v)
+			parseTemplate(tname, filepath.Join(CFG.ProjectFolder, tname+".html"), true)
+			if v.GroupHeader != "" {
+				parseTemplate(v.GroupHeader, filepath.Join(CFG.ProjectFolder, v.GroupHeader+".html"), true)
+			}
+		}
+	}
+}
+
+// parseTemplate adds the template held in xfile to TPL. Static sections
+// are optional but stream templates must exist.
+func parseTemplate(key string, xfile string, required bool) {
+
+	if _, ok := TPL[key]; ok {
+		return
+	}
+	if !fileExists(xfile) {
+		if required {
+			fmt.Printf("Template %v does not exist\n", xfile)
+			os.Exit(1)
+		}
+		return
+	}
+	t, err := template.New(filepath.Base(xfile)).Funcs(templateFuncs).ParseFiles(xfile)
+	if err != nil {
+		fmt.Printf("Parsing error in %v\n%v\n", xfile, err)
+		os.Exit(1)
+	}
+	TPL[key] = t
+}
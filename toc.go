@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The table of contents and bonus index refer to pages which may not have
+// been generated yet so the book is built more than once, each pass using the
+// page numbers from the one before, until the layout settles.
+const maxLayoutPasses = 4
+
+// PREV is the book produced by the previous pass, if any
+var PREV *Book
+
+const defaultTocLinesPerPage = 40
+const defaultIndexLinesPerPage = 50
+
+// TocEntry is one heading in the table of contents
+type TocEntry struct {
+	Level      int
+	Heading    string
+	PageNumber int
+	Anchor     string
+}
+
+// IndexEntry records where a bonus first appears in the book
+type IndexEntry struct {
+	BonusID    string
+	BriefDesc  string
+	Points     string
+	StreamID   string
+	PageNumber int
+	Anchor     string
+}
+
+// TocPage is passed to the toc template once for each page of the contents
+type TocPage struct {
+	Title     string
+	Continued bool
+	Entries   []TocEntry
+}
+
+// IndexPage is passed to the index template once for each page of the index
+type IndexPage struct {
+	Title     string
+	OrderBy   string // id or name
+	Continued bool
+	Entries   []*IndexEntry
+}
+
+const tocTemplate = `
+<div class="page toc">
+<h3>{{.Title}}{{if .Continued}} (continued){{end}}</h3>
+<table class="toc">
+{{range .Entries}}<tr class="toclevel{{.Level}}"><td><a href="#{{.Anchor}}">{{.Heading}}</a></td><td class="pageno">{{.PageNumber}}</td></tr>
+{{end}}</table>
+</div>
+`
+
+const indexTemplate = `
+<div class="page index">
+<h3>{{.Title}}{{if .Continued}} (continued){{end}}</h3>
+<table class="index">
+{{range .Entries}}<tr><td class="BonusID"><a href="#{{.Anchor}}">{{.BonusID}}</a></td><td><a href="#{{.Anchor}}">{{.BriefDesc}}</a></td><td class="pageno">{{.PageNumber}}</td></tr>
+{{end}}</table>
+</div>
+`
+
+var anchorCharsRE = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// bonusAnchor returns the HTML id used for the first appearance of a bonus
+func bonusAnchor(bonusid string) string {
+
+	return "bonus-" + anchorCharsRE.ReplaceAllString(bonusid, "_")
+}
+
+// cleanText returns the plain text of an HTML fragment with its tags already
+// removed, tidying whitespace and entities
+func cleanText(s string) string {
+
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
+
+// bonusRef returns the page number and anchor of the first appearance of a
+// bonus, taken from the previous pass if there is one. A bonus which doesn't
+// appear in the book, or only in streams marked noIndex, has page 0.
+func bonusRef(bonusid string) (int, string) {
+
+	if OUTF == nil {
+		return 0, ""
+	}
+	OUTF.PageRefs = true
+	bk := PREV
+	if bk == nil {
+		bk = OUTF
+	}
+	ie, ok := bk.indexed[bonusid]
+	if !ok {
+		return 0, ""
+	}
+	return ie.PageNumber, ie.Anchor
+}
+
+// bonusPage is available to templates as {{bonusPage "12"}}
+func bonusPage(bonusid string) int {
+
+	pn, _ := bonusRef(bonusid)
+	return pn
+}
+
+// bonusLink is available to templates as {{bonusLink "12"}}, giving the
+// href of the bonus's first appearance
+func bonusLink(bonusid string) string {
+
+	_, anchor := bonusRef(bonusid)
+	if anchor == "" {
+		return ""
+	}
+	return "#" + anchor
+}
+
+// builtinTemplateName is the name of the project's own template for a
+// built-in section, eg rbook.toc
+func builtinTemplateName(section string) string {
+
+	return builtin_prefix + "." + section
+}
+
+// builtinTemplate returns the project's own template for a built-in section,
+// if it has one, otherwise the default
+func builtinTemplate(name string, def string) *template.Template {
+
+	if t, ok := TPL[name]; ok {
+		return t
+	}
+	t := template.Must(template.New(name).Funcs(templateFuncs).Parse(def))
+	TPL[name] = t
+	return t
+}
+
+// emitTOC generates the table of contents from the headings of the previous
+// pass, ignoring any which don't appear on a numbered page
+func emitTOC() {
+
+	OUTF.PageRefs = true
+	var entries []TocEntry
+	if PREV != nil {
+		for _, h := range PREV.Headings {
+			if h.PageNumber > 0 {
+				entries = append(entries, h)
+			}
+		}
+	}
+	lpp := CFG.TocLinesPerPage
+	if lpp < 1 {
+		lpp = defaultTocLinesPerPage
+	}
+	t := builtinTemplate(builtinTemplateName(toc_section), tocTemplate)
+	for i := 0; i == 0 || i < len(entries); i += lpp {
+		pg := TocPage{Title: "Contents", Continued: i > 0, Entries: entries[i:min(i+lpp, len(entries))]}
+		err := OUTF.execute(t, pg)
+		if err != nil {
+			fmt.Printf("toc %v\n", err)
+		}
+	}
+}
+
+// emitIndex generates the bonus index, in BonusID order or, for
+// 'rbook.index.name', in BriefDesc order, from the previous pass
+func emitIndex(sf []string) {
+
+	OUTF.PageRefs = true
+	var entries []*IndexEntry
+	if PREV != nil {
+		entries = append(entries, PREV.Index...)
+	}
+	pg := IndexPage{Title: "Index of bonuses", OrderBy: "id"}
+	if len(sf) > 1 && sf[1] == "name" {
+		pg.Title = "Bonuses by name"
+		pg.OrderBy = "name"
+		sort.SliceStable(entries, func(i, j int) bool {
+			return strings.ToLower(entries[i].BriefDesc) < strings.ToLower(entries[j].BriefDesc)
+		})
+	} else {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return lessBonusID(entries[i].BonusID, entries[j].BonusID)
+		})
+	}
+	lpp := CFG.IndexLinesPerPage
+	if lpp < 1 {
+		lpp = defaultIndexLinesPerPage
+	}
+	t := builtinTemplate(builtinTemplateName(index_section), indexTemplate)
+	for i := 0; i == 0 || i < len(entries); i += lpp {
+		pg.Continued = i > 0
+		pg.Entries = entries[i:min(i+lpp, len(entries))]
+		err := OUTF.execute(t, pg)
+		if err != nil {
+			fmt.Printf("index %v\n", err)
+		}
+	}
+}
+
+// lessBonusID orders numeric BonusIDs numerically and anything else as text
+func lessBonusID(a string, b string) bool {
+
+	x, errx := strconv.Atoi(a)
+	y, erry := strconv.Atoi(b)
+	if errx == nil && erry == nil {
+		return x < y
+	}
+	return a < b
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ValidateParams configures the checking of bonus coordinates before any
+// output is generated
+type ValidateParams struct {
+	Check       bool      `yaml:"check"`
+	Strict      bool      `yaml:"strict"`      // stop, with exit code 1, if there are problems
+	BoundingBox []float64 `yaml:"boundingBox"` // minLat, minLon, maxLat, maxLon
+	Polygon     string    `yaml:"polygon"`     // GeoJSON file of the rally area
+	NearMetres  float64   `yaml:"nearMetres"`  // report bonuses closer than this
+}
+
+// Without a rally area, a bonus is taken to have latitude and longitude
+// swapped if it's far from the others but wouldn't be if they were swapped
+const swappedMinMetres = 100000
+const swappedRatio = 10
+
+// CoordsProblem is one entry in the validation report
+type CoordsProblem struct {
+	BonusID string
+	Problem string
+}
+
+// rallyArea reports whether a point lies within the configured bounding box
+// and polygon, and whether either is configured
+func rallyArea(lat, lon float64, rings []Ring) (bool, bool) {
+
+	bb := CFG.Validate.BoundingBox
+	if len(bb) == 4 && (lat < bb[0] || lon < bb[1] || lat > bb[2] || lon > bb[3]) {
+		return false, true
+	}
+	if len(rings) > 0 && !insideRings(lat, lon, rings) {
+		return false, true
+	}
+	return true, len(bb) == 4 || len(rings) > 0
+}
+
+// medianPosition returns the median latitude and longitude of the bonuses
+func medianPosition(bonuses []*Bonus) (float64, float64) {
+
+	var lats, lons []float64
+	for _, B := range bonuses {
+		lats = append(lats, B.Lat)
+		lons = append(lons, B.Lon)
+	}
+	sort.Float64s(lats)
+	sort.Float64s(lons)
+	return lats[len(lats)/2], lons[len(lons)/2]
+}
+
+// validateCoords checks the coordinates of every bonus in the database and
+// prints a report, returning the number of problems found
+func validateCoords() int {
+
+	if BonusTable == nil {
+		loadBonusTable()
+	}
+	var all, valid []*Bonus
+	for _, B := range BonusTable {
+		all = append(all, B)
+	}
+	sort.Slice(all, func(i, j int) bool { return lessBonusID(all[i].BonusID, all[j].BonusID) })
+
+	var rings []Ring
+	if CFG.Validate.Polygon != "" {
+		var err error
+		rings, err = loadPolygons(projectPath(CFG.Validate.Polygon))
+		if err != nil {
+			fmt.Printf("Can't load rally area: %v\n", err)
+		}
+	}
+	if len(CFG.Validate.BoundingBox) != 0 && len(CFG.Validate.BoundingBox) != 4 {
+		fmt.Println("boundingBox needs minLat, minLon, maxLat, maxLon")
+	}
+
+	var res []CoordsProblem
+	for _, B := range all {
+		switch {
+		case B.Coords == "":
+			res = append(res, CoordsProblem{B.BonusID, "no coordinates"})
+		case !B.ValidCoords:
+			res = append(res, CoordsProblem{B.BonusID, fmt.Sprintf("can't read %q: %v", B.Coords, B.coordsErr)})
+		default:
+			valid = append(valid, B)
+		}
+	}
+
+	var mlat, mlon float64
+	if len(valid) > 0 {
+		mlat, mlon = medianPosition(valid)
+	}
+	for _, B := range valid {
+		inside, checked := rallyArea(B.Lat, B.Lon, rings)
+		swappedInside, _ := rallyArea(B.Lon, B.Lat, rings)
+		switch {
+		case checked && !inside && swappedInside:
+			res = append(res, CoordsProblem{B.BonusID, fmt.Sprintf("outside rally area, latitude and longitude swapped? %v", B.Coords)})
+		case checked && !inside:
+			res = append(res, CoordsProblem{B.BonusID, fmt.Sprintf("outside rally area %v", B.Coords)})
+		case !checked:
+			d := distanceMetres(B.Lat, B.Lon, mlat, mlon)
+			if d > swappedMinMetres && distanceMetres(B.Lon, B.Lat, mlat, mlon) < d/swappedRatio {
+				res = append(res, CoordsProblem{B.BonusID, fmt.Sprintf("latitude and longitude swapped? %v", B.Coords)})
+			}
+		}
+	}
+
+	for i, B := range valid {
+		for _, C := range valid[:i] {
+			if B.Lat == C.Lat && B.Lon == C.Lon {
+				res = append(res, CoordsProblem{B.BonusID, "same position as " + C.BonusID})
+				break
+			}
+			if d := distanceMetres(B.Lat, B.Lon, C.Lat, C.Lon); d < CFG.Validate.NearMetres {
+				res = append(res, CoordsProblem{B.BonusID, fmt.Sprintf("%.0fm from %v", d, C.BonusID)})
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool { return lessBonusID(res[i].BonusID, res[j].BonusID) })
+	fmt.Printf("\nCoordinate validation: %v bonuses checked, %v problems\n", len(all), len(res))
+	for _, p := range res {
+		fmt.Printf("  %-8v %v\n", p.BonusID, p.Problem)
+	}
+	return len(res)
+}